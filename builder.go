@@ -1,6 +1,9 @@
 package earnalliance
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
@@ -17,13 +20,62 @@ type ClientBuilder struct {
 	c *Client
 }
 
-func createRetryableClient(maxAttempts int) *http.Client {
+func (c *Client) createHTTPClient() *http.Client {
+	// Without retries there is nothing for retryablehttp to do,
+	// so a failed request is returned as is.
+	if c.maxRetryAttempts == 0 {
+		return &http.Client{
+			Transport: c.wrapTransport(c.baseTransport(http.DefaultTransport)),
+		}
+	}
+
 	rc := retryablehttp.NewClient()
 	rc.Logger = nil
-	rc.RetryMax = maxAttempts
+	rc.RetryMax = c.maxRetryAttempts
+	rc.RetryWaitMin = c.retryWaitMin
+	rc.RetryWaitMax = c.retryWaitMax
+	if c.retryJitter {
+		rc.Backoff = jitterBackoff
+	}
+	rc.HTTPClient.Transport = c.wrapTransport(c.baseTransport(rc.HTTPClient.Transport))
 	return rc.StandardClient()
 }
 
+// jitterBackoff is the default exponential backoff of retryablehttp, but the wait
+// is a random duration between min and the exponential wait. A wait requested by
+// the server via the Retry-After header is kept as it is.
+func jitterBackoff(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	wait := retryablehttp.DefaultBackoff(min, max, attemptNum, resp)
+	if resp != nil && resp.Header.Get("Retry-After") != "" {
+		return wait
+	}
+	if wait <= min {
+		return wait
+	}
+	return min + time.Duration(rand.Int63n(int64(wait-min)+1))
+}
+
+// baseTransport applies the transport options to the transport that performs the HTTP requests.
+func (c *Client) baseTransport(rt http.RoundTripper) http.RoundTripper {
+	t, ok := rt.(*http.Transport)
+	if !ok || c.responseHeaderTimeout == 0 {
+		return rt
+	}
+
+	// The default transport is shared, so it is never modified
+	t = t.Clone()
+	t.ResponseHeaderTimeout = c.responseHeaderTimeout
+	return t
+}
+
+// wrapTransport wraps the transport that performs the individual HTTP attempts.
+func (c *Client) wrapTransport(rt http.RoundTripper) http.RoundTripper {
+	if c.httpTap != nil {
+		rt = &tapTransport{next: rt, tap: c.httpTap}
+	}
+	return rt
+}
+
 // NewClientBuilder creates a new ClientBuilder. It also sets the default values
 // in the underlying client. And looks for the environment variables:
 // ALLIANCE_CLIENT_ID, ALLIANCE_CLIENT_SECRET, ALLIANCE_GAME_ID and ALLIANCE_DSN.
@@ -37,22 +89,45 @@ func NewClientBuilder() *ClientBuilder {
 	}
 
 	cb := &ClientBuilder{
-		c: &Client{
-			dsn:              dsn,
-			gameID:           gameID,
-			clientID:         clientID,
-			clientSecret:     clientSecret,
-			batchSize:        defaultBatchSize,
-			stopBatchHandler: make(chan struct{}),
-			flushInterval:    defaultFlushInterval,
-			flushCooldown:    defaultFlushCooldown,
-			httpClient:       createRetryableClient(defaultMaxRetryAttempts),
-		},
+		c: newClient(options{
+			dsn:                     dsn,
+			gameID:                  gameID,
+			clientID:                clientID,
+			clientSecret:            clientSecret,
+			batchSize:               defaultBatchSize,
+			asyncBatchFlush:         true,
+			flushOnIdentifier:       true,
+			errorEventName:          defaultErrorEventName,
+			startGameEventName:      StartGameEvent,
+			flushInterval:           defaultFlushInterval,
+			flushCooldown:           defaultFlushCooldown,
+			clock:                   systemClock{},
+			clientIDHeader:          defaultClientIDHeader,
+			timestampHeader:         defaultTimestampHeader,
+			signatureHeader:         defaultSignatureHeader,
+			timeFunc:                time.Now,
+			selfTelemetryUserID:     DefaultSelfTelemetryUserID,
+			maxRetryAttempts:        defaultMaxRetryAttempts,
+			retryWaitMin:            defaultRetryWaitMin,
+			retryWaitMax:            defaultRetryWaitMax,
+			onceMaxKeys:             defaultTrackOnceMaxKeys,
+			startGameSessionTimeout: defaultStartGameSessionTimeout,
+		}),
 	}
 
 	return cb
 }
 
+// newClient creates a client with the options, and the runtime fields set up.
+func newClient(o options) *Client {
+	return &Client{
+		options:            o,
+		stopBatchHandler:   make(chan struct{}),
+		flushSignal:        make(chan FlushTrigger, 1),
+		flushIntervalReset: make(chan struct{}, 1),
+	}
+}
+
 // WithMaxRetryAttempts sets the maximum number of retries before
 // an HTTP request is considered as failed and the library returns an error.
 // Default: 5
@@ -62,12 +137,109 @@ func (cb *ClientBuilder) WithMaxRetryAttempts(maxAttempts int) *ClientBuilder {
 		panic("max retry attempts must be at least 1")
 	}
 
-	cb.c.httpClient = createRetryableClient(maxAttempts)
+	cb.c.maxRetryAttempts = maxAttempts
+	return cb
+}
+
+// WithRetryWaitMin sets the minimum time to wait before retrying a failed HTTP request.
+// The wait grows exponentially with every attempt, from this minimum up to the maximum
+// set via WithRetryWaitMax. It can't be greater than the maximum.
+// Default: 1 second
+// This is optional.
+func (cb *ClientBuilder) WithRetryWaitMin(d time.Duration) *ClientBuilder {
+	if d < 0 {
+		panic("retry wait min must be at least 0")
+	}
+
+	cb.c.retryWaitMin = d
+	return cb
+}
+
+// WithRetryWaitMax sets the maximum time to wait before retrying a failed HTTP request.
+// It can't be less than the minimum set via WithRetryWaitMin.
+// Default: 30 seconds
+// This is optional.
+func (cb *ClientBuilder) WithRetryWaitMax(d time.Duration) *ClientBuilder {
+	if d < 0 {
+		panic("retry wait max must be at least 0")
+	}
+
+	cb.c.retryWaitMax = d
+	return cb
+}
+
+// WithRetryJitter sets whether the wait before retrying a failed HTTP request is randomized.
+// When enabled, the wait is a random duration between the minimum wait and the exponential wait,
+// so clients that failed at the same time, e.g. during an outage, don't retry in lockstep.
+// A wait requested by the API via the Retry-After header is not randomized.
+// Default: false
+// This is optional.
+func (cb *ClientBuilder) WithRetryJitter(jitter bool) *ClientBuilder {
+	cb.c.retryJitter = jitter
+	return cb
+}
+
+// WithResponseHeaderTimeout sets the maximum time to wait for the response headers
+// after the request, including its body, was written. Unlike an overall request timeout,
+// this doesn't limit the time spent uploading a large batch over a slow link, but it still
+// detects a server that hangs quickly. A request that times out is retried like any other
+// failed request. Build panics if a custom transport is set via WithTransport, or if the
+// timeout isn't less than the flush deadline, as it would have no effect.
+// Default: 0, no timeout
+// This is optional.
+func (cb *ClientBuilder) WithResponseHeaderTimeout(d time.Duration) *ClientBuilder {
+	if d < 0 {
+		panic("response header timeout must be at least 0")
+	}
+
+	cb.c.responseHeaderTimeout = d
+	return cb
+}
+
+// WithFlushDeadline sets the maximum time a single flush may take, across all of
+// its batches and the retries of their HTTP requests. Once it is exceeded, the flush
+// is aborted and its error wraps context.DeadlineExceeded. The items that weren't sent
+// stay queued. This bounds how long a flush can tie up the batch handler during an outage.
+// Default: 0, no deadline
+// This is optional.
+func (cb *ClientBuilder) WithFlushDeadline(d time.Duration) *ClientBuilder {
+	if d < 0 {
+		panic("flush deadline must be at least 0")
+	}
+
+	cb.c.flushDeadline = d
+	return cb
+}
+
+// WithoutRetry disables retries entirely. Every HTTP request is attempted
+// exactly once, and a failed request returns its error immediately.
+// Use this if retries are already handled by another layer in front of the API.
+// This overrides WithMaxRetryAttempts.
+// This is optional.
+func (cb *ClientBuilder) WithoutRetry() *ClientBuilder {
+	cb.c.maxRetryAttempts = 0
+	return cb
+}
+
+// WithShutdownTimeout makes Close send what is queued before it closes the client, within timeout,
+// so a dead endpoint can't make it hang. If it doesn't finish in time, Close gives up and returns
+// an error wrapping ErrShutdownTimeout, and with WithOfflineSpool, it spools what is still queued.
+// A batch that is being sent by the batch handler when Close gives up is left to finish in the background.
+// It panics if timeout is negative.
+// Default: 0, which closes the client without sending what is queued
+// This is optional.
+func (cb *ClientBuilder) WithShutdownTimeout(timeout time.Duration) *ClientBuilder {
+	if timeout < 0 {
+		panic("shutdown timeout must be at least 0")
+	}
+	cb.c.shutdownTimeout = timeout
 	return cb
 }
 
 // WithFlushInterval sets the flush interval which is the time between
 // flushes without the event queue hitting the batch size.
+// An interval of 0 disables these flushes, so the queue is only flushed
+// when it hits the batch size, or when it is flushed explicitly.
 // Default: 30 seconds
 // This is optional.
 func (cb *ClientBuilder) WithFlushInterval(interval time.Duration) *ClientBuilder {
@@ -82,7 +254,7 @@ func (cb *ClientBuilder) WithFlushInterval(interval time.Duration) *ClientBuilde
 // WithFlushCooldown sets the flush cooldown which is the minimum
 // required time between Flush() calls. During this cooldown period,
 // a Flush() call will start a timer in a goroutine that will
-// flush afterwards.
+// flush afterwards. A cooldown of 0 sends every flush right away.
 // Default: 10 seconds
 // This is optional.
 func (cb *ClientBuilder) WithFlushCooldown(cooldown time.Duration) *ClientBuilder {
@@ -94,6 +266,49 @@ func (cb *ClientBuilder) WithFlushCooldown(cooldown time.Duration) *ClientBuilde
 	return cb
 }
 
+// WithMinFlushBatch sets the number of queued items that a flush needs to be sent right away
+// once the flush cooldown is over. With fewer items, the flush is scheduled for one cooldown later,
+// like a flush during the cooldown, so the first flush after an idle period doesn't send a batch
+// with a single event. It has no effect without a flush cooldown, and 0 sends every flush right away.
+// It panics if n is negative.
+// Default: 0
+// This is optional.
+func (cb *ClientBuilder) WithMinFlushBatch(n int) *ClientBuilder {
+	if n < 0 {
+		panic("min flush batch must be at least 0")
+	}
+	cb.c.minFlushBatch = n
+	return cb
+}
+
+// WithClock sets the source of time of the flush cooldown, including the timer of
+// a flush that waits for the cooldown, and of the retention of TrackOnce. This is mainly
+// for tests, which can pass a fake clock to exercise them deterministically without sleeping.
+// Default: the system clock
+// This is optional.
+func (cb *ClientBuilder) WithClock(clock Clock) *ClientBuilder {
+	if clock == nil {
+		panic("clock cannot be nil")
+	}
+
+	cb.c.clock = clock
+	return cb
+}
+
+// WithTimeFunc sets the source of the time of the events that are tracked, e.g. to make it
+// deterministic in tests, or to use a time source that is synchronized via NTP.
+// Unlike WithClock, it doesn't affect the flush cooldown.
+// Default: time.Now
+// This is optional.
+func (cb *ClientBuilder) WithTimeFunc(now func() time.Time) *ClientBuilder {
+	if now == nil {
+		panic("time func cannot be nil")
+	}
+
+	cb.c.timeFunc = now
+	return cb
+}
+
 // WithBatchSize sets the batch size which is the maximum size
 // of the event queue where it will be flushed automatically if reached.
 // Default: 100
@@ -107,8 +322,388 @@ func (cb *ClientBuilder) WithBatchSize(batchSize int) *ClientBuilder {
 	return cb
 }
 
+// WithBatchComposition sets how many identifier updates and events go into a batch
+// when there are more of them queued than fit into one.
+// Default: BatchCompositionIdentifiersFirst
+// This is optional.
+func (cb *ClientBuilder) WithBatchComposition(composition BatchComposition) *ClientBuilder {
+	switch composition {
+	case BatchCompositionIdentifiersFirst, BatchCompositionEventsFirst, BatchCompositionInterleaved:
+	default:
+		panic("unknown batch composition")
+	}
+
+	cb.c.batchComposition = composition
+	return cb
+}
+
+// WithAsyncBatchFlush sets whether a full batch is sent asynchronously.
+// When enabled, the batch handler goroutine is woken up to send a full batch,
+// so the call that filled it (e.g. Track) returns immediately.
+// When disabled, that call sends the batch to the API itself and waits for the request.
+// Default: true
+// This is optional.
+func (cb *ClientBuilder) WithAsyncBatchFlush(async bool) *ClientBuilder {
+	cb.c.asyncBatchFlush = async
+	return cb
+}
+
+// WithFlushOnIdentifier sets whether SetIdentifiers flushes the queue.
+// When disabled, identifiers are only queued and sent with the next flush,
+// which is useful when setting many identifiers before tracking events.
+// A full batch is still flushed.
+// Default: true
+// This is optional.
+func (cb *ClientBuilder) WithFlushOnIdentifier(flush bool) *ClientBuilder {
+	cb.c.flushOnIdentifier = flush
+	return cb
+}
+
+// WithMaxInFlightFlushes sets the maximum number of batches that are sent to the API at once.
+// Flushes that are triggered while the limit is reached don't send anything themselves,
+// instead they are coalesced into a single flush that runs once a flush in flight is done.
+// The flushes that return the error of sending the batches, like ForceFlush, FlushBlocking,
+// FlushUser, Round.Flush and ReplaySpool, wait for a flush in flight to be done instead,
+// or for their context to be done.
+// Default: unlimited
+// This is optional.
+func (cb *ClientBuilder) WithMaxInFlightFlushes(n int) *ClientBuilder {
+	if n < 1 {
+		panic("max in flight flushes must be at least 1")
+	}
+
+	cb.c.maxInFlightFlushes = n
+	return cb
+}
+
+// WithMaxBatchesPerFlush sets the maximum number of batches a single flush sends while it
+// drains the queue. The rest stays queued for the next flush, which bounds the burst of
+// requests after a long backlog, e.g. once the API recovers from an outage.
+// Default: unlimited
+// This is optional.
+func (cb *ClientBuilder) WithMaxBatchesPerFlush(n int) *ClientBuilder {
+	if n < 1 {
+		panic("max batches per flush must be at least 1")
+	}
+
+	cb.c.maxBatchesPerFlush = n
+	return cb
+}
+
+// WithSelfTelemetry sets whether the client queues events about its own health, so they show up
+// in the same analytics stream as the other events. These are SelfTelemetryDropEvent for the items
+// that were dropped without being sent, and SelfTelemetrySendFailureEvent for the batches that failed
+// to send. They are queued when the queue is flushed, and there is never more than one of each queued,
+// while one is queued, the counts add up for the next one.
+// Default: false
+// This is optional.
+func (cb *ClientBuilder) WithSelfTelemetry(enabled bool) *ClientBuilder {
+	cb.c.selfTelemetry = enabled
+	return cb
+}
+
+// WithSelfTelemetryUserID sets the user ID of the self telemetry events.
+// Default: DefaultSelfTelemetryUserID
+// This is optional.
+func (cb *ClientBuilder) WithSelfTelemetryUserID(userID string) *ClientBuilder {
+	if userID == "" {
+		panic("self telemetry user id cannot be empty")
+	}
+
+	cb.c.selfTelemetryUserID = userID
+	return cb
+}
+
+// WithEventFilter sets a function that decides which events are queued, events for which
+// it returns false are never queued, e.g. to filter out debug events in production.
+// It is called with the event as it would be queued, after the event name transform, the
+// traits and the defaults were applied. It applies to all tracking methods including the
+// ones of rounds, except StartGame, unless WithStartGameFiltered is enabled.
+// It is called on the goroutine that tracks the event, so it should be fast.
+// Default: N/A
+// This is optional.
+func (cb *ClientBuilder) WithEventFilter(filter func(e Event) bool) *ClientBuilder {
+	cb.c.eventFilter = filter
+	return cb
+}
+
+// WithStartGameFiltered sets whether the event filter set via WithEventFilter
+// also applies to the events of StartGame.
+// Default: false
+// This is optional.
+func (cb *ClientBuilder) WithStartGameFiltered(filtered bool) *ClientBuilder {
+	cb.c.filterStartGame = filtered
+	return cb
+}
+
+// WithCoalesceIdentifierRemovals sets whether the removal of an identifier is left out of an
+// update, if the latest queued update of the same identifier of the user already removes it,
+// e.g. when the same removal is submitted several times during a bulk offboarding. Updates that
+// are left without any identifiers aren't queued at all. Removals that are being sent already
+// aren't queued anymore, so they aren't coalesced.
+// Default: false
+// This is optional.
+func (cb *ClientBuilder) WithCoalesceIdentifierRemovals(coalesce bool) *ClientBuilder {
+	cb.c.coalesceIdentifierRemovals = coalesce
+	return cb
+}
+
+// WithStrictIdentifiers sets whether SetIdentifiers rejects an update with an empty identifier that
+// wasn't created by RemoveIdentifier, or by the Remove methods. Such an identifier would remove the
+// identifier from the user, which is most likely an accident, e.g. an empty variable. The rejected
+// update isn't queued, and an error wrapping ErrEmptyIdentifier is sent to the error channel.
+// Default: false
+// This is optional.
+func (cb *ClientBuilder) WithStrictIdentifiers(strict bool) *ClientBuilder {
+	cb.c.strictIdentifiers = strict
+	return cb
+}
+
+// WithQueue sets the queue that stores the events and identifier updates until they are sent,
+// instead of keeping them in memory, e.g. to make them durable, or to share them between processes.
+// The items that couldn't be sent, and the ones queued by the client itself, e.g. self telemetry,
+// are still kept in memory, and they are sent before the items of the queue. The functions that work
+// with the queued items, like the purging and the flushing of a single user or round, as well as
+// event priorities, identifier removal coalescing and the maximum age of identifier updates,
+// only apply to the items in memory. Errors of the queue are sent to the error channel.
+// Default: N/A
+// This is optional.
+func (cb *ClientBuilder) WithQueue(queue Queue) *ClientBuilder {
+	if queue == nil {
+		panic("queue cannot be nil")
+	}
+	cb.c.queue = queue
+	return cb
+}
+
+// WithMetricsInterval sets a function that is passed a snapshot of the stats of the client
+// every interval, e.g. to push them to a monitoring system, instead of polling Stats.
+// It is called on its own goroutine, which is started with the client and stopped by Close.
+// Close waits for it to return, so it must not call Close.
+// It panics if interval isn't positive, or if callback is nil.
+// Default: N/A
+// This is optional.
+func (cb *ClientBuilder) WithMetricsInterval(interval time.Duration, callback func(Stats)) *ClientBuilder {
+	if interval <= 0 {
+		panic("metrics interval must be positive")
+	}
+	if callback == nil {
+		panic("metrics callback cannot be nil")
+	}
+	cb.c.metricsInterval = interval
+	cb.c.metricsCallback = callback
+	return cb
+}
+
+// WithTrackOnceKey sets the function that returns the key of an event submitted by TrackOnce,
+// e.g. to send an event once per user regardless of its name, or once per game.
+// The events with the same key are only sent once.
+// Default: the user ID and the event name
+// This is optional.
+func (cb *ClientBuilder) WithTrackOnceKey(key func(userID string, eventName string) string) *ClientBuilder {
+	if key == nil {
+		panic("track once key cannot be nil")
+	}
+	cb.c.trackOnceKey = key
+	return cb
+}
+
+// WithTrackOnceRetention sets for how long TrackOnce remembers the key of an event, after which
+// the event can be sent again, where 0 is the lifetime of the client, and the maximum number of
+// keys it remembers, beyond which the oldest ones are forgotten.
+// It panics if retention is negative, or if maxKeys is less than 1.
+// Default: 0 and 10000
+// This is optional.
+func (cb *ClientBuilder) WithTrackOnceRetention(retention time.Duration, maxKeys int) *ClientBuilder {
+	if retention < 0 {
+		panic("track once retention must be at least 0")
+	}
+	if maxKeys < 1 {
+		panic("track once max keys must be at least 1")
+	}
+	cb.c.onceRetention = retention
+	cb.c.onceMaxKeys = maxKeys
+	return cb
+}
+
+// WithUniqueRoundIDs sets whether StartRound checks that the ID of a round isn't used by another
+// round, e.g. because of a copy-paste bug, as the events of both would have the same GroupID.
+// A round uses its ID until Round.End is called, after which another round can use it.
+// An error wrapping ErrDuplicateRoundID is sent to the error channel on a collision.
+// The IDs of the rounds that aren't ended are kept in memory for the lifetime of the client.
+// Default: false
+// This is optional.
+func (cb *ClientBuilder) WithUniqueRoundIDs(unique bool) *ClientBuilder {
+	cb.c.uniqueRoundIDs = unique
+	return cb
+}
+
+// WithPayloadSizeWarning sets a function that is called with the size of a marshalled payload
+// in bytes when it is greater than threshold, before it is sent anyway. This is a warning
+// that the payloads are getting close to the size the API accepts, e.g. to lower the batch size
+// before the requests start to fail. It is called on the goroutine that sends the payload, so it should be fast.
+// It panics if threshold is less than 1, or if callback is nil.
+// Default: N/A
+// This is optional.
+func (cb *ClientBuilder) WithPayloadSizeWarning(threshold int, callback func(size int)) *ClientBuilder {
+	if threshold < 1 {
+		panic("payload size warning threshold must be at least 1")
+	}
+	if callback == nil {
+		panic("payload size warning callback cannot be nil")
+	}
+	cb.c.payloadSizeWarning = threshold
+	cb.c.onPayloadSizeWarning = callback
+	return cb
+}
+
+// WithIdentifierValidator sets the function that validates the values of field passed to
+// SetIdentifiers, e.g. to check that Steam IDs have 17 digits. A field whose value fails
+// the validation is left out of the update, or the whole update is rejected with
+// WithRejectInvalidIdentifiers, and the error is sent to the error channel.
+// Removals aren't validated. Setting the validator of a field again replaces it.
+// It panics if field is not a known field, or if validator is nil.
+// Default: N/A
+// This is optional.
+func (cb *ClientBuilder) WithIdentifierValidator(field IdentifierField, validator func(value string) error) *ClientBuilder {
+	if _, ok := identifierFieldIndex[field]; !ok {
+		panic("unknown identifier field: " + string(field))
+	}
+	if validator == nil {
+		panic("identifier validator cannot be nil")
+	}
+	if cb.c.identifierValidators == nil {
+		cb.c.identifierValidators = make(map[IdentifierField]func(value string) error)
+	}
+	cb.c.identifierValidators[field] = validator
+	return cb
+}
+
+// WithRejectInvalidIdentifiers sets whether an identifier update with a field that fails its
+// validator set via WithIdentifierValidator is rejected as a whole, instead of just the field.
+// Default: false
+// This is optional.
+func (cb *ClientBuilder) WithRejectInvalidIdentifiers(reject bool) *ClientBuilder {
+	cb.c.rejectInvalidIdentifiers = reject
+	return cb
+}
+
+// WithOnFlush sets a function that is called after every flush of the queue, with what
+// triggered it, and the error of sending the batches, e.g. to log why the flushes happen
+// to tune the batch size and the flush interval. It isn't called for the flushes that
+// were coalesced with the ones in flight, nor for the ones that only send the items of
+// a user or a round. It is called on the goroutine that flushed, so it should be fast.
+// Default: N/A
+// This is optional.
+func (cb *ClientBuilder) WithOnFlush(callback func(trigger FlushTrigger, err error)) *ClientBuilder {
+	cb.c.onFlush = callback
+	return cb
+}
+
+// WithQueueObserver sets a function that is called every time an event or an identifier
+// update is queued, with the kind of the queue and its length after the item was added.
+// It is called on the goroutine that queued the item, after the queue is unlocked,
+// so it should be fast. It must not call the client, as that can deadlock.
+// Default: N/A
+// This is optional.
+func (cb *ClientBuilder) WithQueueObserver(observer func(kind QueueKind, depth int)) *ClientBuilder {
+	cb.c.queueObserver = observer
+	return cb
+}
+
+// WithOnDrop sets a function that is called with the events and identifier updates
+// that are dropped without being sent, along with the reason they were dropped.
+// This keeps drops apart from the send failures that go to the error channel,
+// e.g. events that can't be marshalled are passed to it instead of being reported as errors.
+// It is called on the goroutine that dropped the items, so it should be fast.
+// Default: N/A
+// This is optional.
+func (cb *ClientBuilder) WithOnDrop(onDrop func(reason DropReason, events []Event, identifiers []UserIdentifiers)) *ClientBuilder {
+	cb.c.onDrop = onDrop
+	return cb
+}
+
+// WithIdentifierMaxAge sets the maximum time an identifier update is queued for.
+// Older updates are dropped when the queue is flushed, and passed to the drop callback,
+// so a stale identity state isn't sent after a long outage, when it may have been superseded.
+// The age includes the time spent queued again after failed sends.
+// Default: 0, no maximum age
+// This is optional.
+func (cb *ClientBuilder) WithIdentifierMaxAge(d time.Duration) *ClientBuilder {
+	if d < 0 {
+		panic("identifier max age must be at least 0")
+	}
+
+	cb.c.identifierMaxAge = d
+	return cb
+}
+
+// WithBaseContext sets a function that supplies the context of the HTTP requests of the flushes
+// that aren't passed a context, e.g. to propagate tracing or a deadline. It is called once
+// per flush, on the goroutine that flushes. These flushes are Flush, the flushes that wait
+// for the cooldown or are due to the flush interval, and the ones triggered by the batch size.
+// A batch size triggered flush runs on the goroutine that tracked the event unless async batch
+// flushes are enabled, in which case it runs on the batch handler goroutine just like the others.
+// Flushes that are passed a context, like FlushBlocking or Round.TrackContext, use that instead.
+// Default: context.Background
+// This is optional.
+func (cb *ClientBuilder) WithBaseContext(baseContext func() context.Context) *ClientBuilder {
+	cb.c.baseContext = baseContext
+	return cb
+}
+
+// WithPreflightCheck sets whether Build checks that the API accepts the credentials of the client
+// via Ping, before it returns the client, so rotated or mistyped credentials are caught at startup
+// instead of at the first flush. Build panics if the API rejects the credentials with a 401 or 403
+// status. Any other error, e.g. when the API can't be reached, is sent to the error channel instead,
+// and the client is returned as usual. The request is retried like any other, bounded by the flush
+// deadline set via WithFlushDeadline, if there is one. Call Ping on the client to handle the error yourself.
+// With WithResponseParser or a custom transport set via WithTransport, the credentials only count
+// as rejected if the error is or wraps an *APIError with a 401 or 403 status.
+// Default: false
+// This is optional.
+func (cb *ClientBuilder) WithPreflightCheck(check bool) *ClientBuilder {
+	cb.c.preflightCheck = check
+	return cb
+}
+
+// WithDeferredStart makes Build return a client whose batch handler goroutine isn't
+// started until Start is called, e.g. once the consumer of the error channel is up.
+// Default: the batch handler is started by Build
+// This is optional.
+func (cb *ClientBuilder) WithDeferredStart() *ClientBuilder {
+	cb.c.deferredStart = true
+	return cb
+}
+
+// WithOmitEmptyArrays sets whether the events or identifiers arrays are left out
+// of the payload when they are empty, for backends that don't accept empty arrays.
+// Otherwise both arrays are always present, even when empty.
+// Default: false
+// This is optional.
+func (cb *ClientBuilder) WithOmitEmptyArrays(omit bool) *ClientBuilder {
+	cb.c.omitEmptyArrays = omit
+	return cb
+}
+
+// WithOfflineSpool sets a file where the payloads that fail to send are appended to,
+// one JSON payload per line, instead of being dropped. They can be sent again
+// with ReplaySpool, or shipped by a separate uploader process. The file is created if needed.
+// Default: N/A
+// This is optional.
+func (cb *ClientBuilder) WithOfflineSpool(path string) *ClientBuilder {
+	if path == "" {
+		panic("spool path cannot be empty")
+	}
+
+	cb.c.spoolPath = path
+	return cb
+}
+
 // WithErrorChannel sets the error channel where the asynchronous Flush calls
 // will send their errors to. Multiple errors may be sent at once.
+// The channel should only be closed after Close, the errors that happen
+// after it was closed are dropped.
 // Default: N/A
 // This is optional.
 func (cb *ClientBuilder) WithErrorChannel(ch chan error) *ClientBuilder {
@@ -116,7 +711,234 @@ func (cb *ClientBuilder) WithErrorChannel(ch chan error) *ClientBuilder {
 	return cb
 }
 
+// WithHTTPTap sets a function that is called after every HTTP attempt
+// with copies of the request and response. This is meant for debugging,
+// e.g. to inspect the signature headers and the raw response of the API.
+// Build panics if it is set along with a custom transport set via WithTransport.
+// Default: N/A
+// This is optional.
+func (cb *ClientBuilder) WithHTTPTap(tap HTTPTap) *ClientBuilder {
+	cb.c.httpTap = tap
+	return cb
+}
+
+// WithStrictResponseParsing sets whether a request only succeeds if the API responds with
+// a 2xx status and the success message. Any other response is returned as an *APIError.
+// When disabled, any response below 500 with the success message is a success.
+// Build panics if it is enabled along with a custom transport set via WithTransport.
+// Default: false
+// This is optional.
+func (cb *ClientBuilder) WithStrictResponseParsing(strict bool) *ClientBuilder {
+	cb.c.strictResponseParsing = strict
+	return cb
+}
+
+// WithResponseParser sets the function that decides whether a response of the API is a success,
+// e.g. for API versions or proxies that respond with {"success":true}, or with an empty body.
+// The error it returns is the error of the request.
+// Build panics if it is set along with strict response parsing, or with a custom transport
+// set via WithTransport.
+// Default: any response below 500 with the message "OK" is a success,
+// and the message under the "error" key is returned as an error
+// This is optional.
+func (cb *ClientBuilder) WithResponseParser(parser ResponseParser) *ClientBuilder {
+	if parser == nil {
+		panic("response parser cannot be nil")
+	}
+	cb.c.responseParser = parser
+	return cb
+}
+
+// WithTransport sets the transport that sends the requests to the API.
+// Setting this ignores the options of the default HTTP client, like retries and the HTTP tap.
+// See MemoryTransport for a transport that is useful in tests.
+// Default: an HTTP client with retries
+// This is optional.
+func (cb *ClientBuilder) WithTransport(t Transport) *ClientBuilder {
+	if t == nil {
+		panic("transport cannot be nil")
+	}
+
+	cb.c.transport = t
+	return cb
+}
+
+// WithGlobalTraits sets traits that are added to every event, including START_GAME.
+// The traits of a round overwrite the global traits with the same keys,
+// and the traits passed when tracking an event overwrite both.
+// Default: N/A
+// This is optional.
+func (cb *ClientBuilder) WithGlobalTraits(traits Traits) *ClientBuilder {
+	cb.c.globalTraits = combineTraits(traits)
+	return cb
+}
+
+// WithTrimTraitStrings sets whether the leading and trailing whitespace is trimmed
+// from the string values of the traits of every event when it is tracked, including
+// the global traits and the traits of rounds, e.g. so " forest " and "forest" end up
+// in the same bucket. The keys of the traits and values of other types are kept as they are.
+// Default: false
+// This is optional.
+func (cb *ClientBuilder) WithTrimTraitStrings(trim bool) *ClientBuilder {
+	cb.c.trimTraitStrings = trim
+	return cb
+}
+
+// WithEventNameTransform sets a function that is applied to the name of every
+// tracked event, e.g. strings.ToUpper to keep the event names consistent.
+// It is not applied to the reserved event sent by StartGame.
+// Default: N/A
+// This is optional.
+func (cb *ClientBuilder) WithEventNameTransform(transform func(string) string) *ClientBuilder {
+	cb.c.eventNameTransform = transform
+	return cb
+}
+
+// WithValueFormatter sets a function that formats the value of every event when it is sent,
+// e.g. to send it as a string or as a scaled integer. It is called with nil for events
+// without a value, and the value is left out of the event if it returns nil.
+// The events in the queue keep their values as they are.
+// Default: the value as a number, or left out if nil
+// This is optional.
+func (cb *ClientBuilder) WithValueFormatter(formatter func(value *int) any) *ClientBuilder {
+	cb.c.valueFormatter = formatter
+	return cb
+}
+
+// WithSigner sets the function that signs the requests. The default signer
+// is the hex encoded HMAC-SHA256 of clientID + timestamp + body, keyed with the client secret.
+// Only change this if the API expects a different signing scheme.
+// Default: HMAC-SHA256
+// This is optional.
+func (cb *ClientBuilder) WithSigner(signer Signer) *ClientBuilder {
+	if signer == nil {
+		panic("signer cannot be nil")
+	}
+
+	cb.c.signer = signer
+	return cb
+}
+
+// WithMarshaler sets the function that marshals the JSON payloads, e.g. json.Marshal
+// of a faster JSON library. The payload is signed exactly as it is returned by the marshaler.
+// Default: encoding/json
+// This is optional.
+func (cb *ClientBuilder) WithMarshaler(marshaler func(v any) ([]byte, error)) *ClientBuilder {
+	if marshaler == nil {
+		panic("marshaler cannot be nil")
+	}
+
+	cb.c.marshaler = marshaler
+	return cb
+}
+
+// WithSignatureEncoding sets how the signature of the default signer is encoded
+// in the x-signature header. It has no effect when a custom signer is set via WithSigner.
+// Only change this if a proxy in front of the API expects a different encoding.
+// Default: SignatureEncodingHex
+// This is optional.
+func (cb *ClientBuilder) WithSignatureEncoding(encoding SignatureEncoding) *ClientBuilder {
+	if encoding != SignatureEncodingHex && encoding != SignatureEncodingBase64 {
+		panic("unknown signature encoding")
+	}
+
+	cb.c.signatureEncoding = encoding
+	return cb
+}
+
+// WithPayloadEncoding sets how the batches are encoded in the body of the requests, e.g. as NDJSON
+// to send them to a generic log ingestion endpoint instead of the API. The signature covers the
+// encoded body. Build panics if NDJSON is set along with WithOfflineSpool, whose file can't hold
+// payloads of more than one line, or with WithOmitEmptyArrays, which has no effect on NDJSON.
+// It panics if encoding is unknown.
+// Default: PayloadEncodingJSON
+// This is optional.
+func (cb *ClientBuilder) WithPayloadEncoding(encoding PayloadEncoding) *ClientBuilder {
+	if encoding != PayloadEncodingJSON && encoding != PayloadEncodingNDJSON {
+		panic("unknown payload encoding")
+	}
+	cb.c.payloadEncoding = encoding
+	return cb
+}
+
+// WithStartGameEventName sets the name of the events submitted by StartGame,
+// for backends that expect a different session start event.
+// Like the default name, it is not changed by the event name transform.
+// Default: START_GAME
+// This is optional.
+func (cb *ClientBuilder) WithStartGameEventName(name string) *ClientBuilder {
+	if name == "" {
+		panic("start game event name cannot be empty")
+	}
+
+	cb.c.startGameEventName = name
+	return cb
+}
+
+// WithStartGameSessionTimeout sets for how long StartGameSession submits the start game event
+// of a session only once, after which it is submitted again, as it is most likely a new session.
+// It panics if timeout isn't positive.
+// Default: 30 minutes
+// This is optional.
+func (cb *ClientBuilder) WithStartGameSessionTimeout(timeout time.Duration) *ClientBuilder {
+	if timeout <= 0 {
+		panic("start game session timeout must be positive")
+	}
+	cb.c.startGameSessionTimeout = timeout
+	return cb
+}
+
+// WithOnStart sets a function that is called by Build once the batch handler goroutine
+// is started, e.g. to tie the client into the lifecycle of an application framework.
+// Default: N/A
+// This is optional.
+func (cb *ClientBuilder) WithOnStart(onStart func()) *ClientBuilder {
+	cb.c.onStart = onStart
+	return cb
+}
+
+// WithOnStop sets a function that is called by Close once the batch handler goroutine
+// is stopped. It is only called by the first Close.
+// Default: N/A
+// This is optional.
+func (cb *ClientBuilder) WithOnStop(onStop func()) *ClientBuilder {
+	cb.c.onStop = onStop
+	return cb
+}
+
+// WithDefaultSchema sets the schema, i.e. the version of the event taxonomy, that every event
+// conforms to unless it is tracked with another one via TrackWithSchema.
+// It lets the API route and validate events as their shapes evolve.
+// Default: N/A, the schema is left out of the events
+// This is optional.
+func (cb *ClientBuilder) WithDefaultSchema(schema string) *ClientBuilder {
+	cb.c.defaultSchema = schema
+	return cb
+}
+
+// WithErrorEventName sets the name of the events submitted by TrackError.
+// Default: ERROR
+// This is optional.
+func (cb *ClientBuilder) WithErrorEventName(name string) *ClientBuilder {
+	if name == "" {
+		panic("error event name cannot be empty")
+	}
+
+	cb.c.errorEventName = name
+	return cb
+}
+
+// WithErrorStackTrace sets whether TrackError adds the stack trace
+// of its caller to the traits of the event, under the "stack" key.
+// Default: false
+// This is optional.
+func (cb *ClientBuilder) WithErrorStackTrace(stackTrace bool) *ClientBuilder {
+	cb.c.errorStackTrace = stackTrace
+	return cb
+}
+
 // WithDSN sets the DSN (the URL that requests are sent to) for the Earn Alliance API.
+// It must use https, unless WithAllowInsecureHTTP is set.
 // Default: https://events.earnalliance.com/v2/custom-events
 // This is optional.
 func (cb *ClientBuilder) WithDSN(dsn string) *ClientBuilder {
@@ -134,6 +956,43 @@ func (cb *ClientBuilder) WithDSN(dsn string) *ClientBuilder {
 	return cb
 }
 
+// WithAuthHeaderNames sets the names of the headers that carry the client ID, the timestamp
+// and the signature of a request, e.g. to match the contract of an API gateway in front of the API.
+// Default: x-client-id, x-timestamp and x-signature
+// This is optional.
+func (cb *ClientBuilder) WithAuthHeaderNames(clientID, timestamp, signature string) *ClientBuilder {
+	if clientID == "" || timestamp == "" || signature == "" {
+		panic("auth header names cannot be empty")
+	}
+	if strings.EqualFold(clientID, timestamp) || strings.EqualFold(clientID, signature) || strings.EqualFold(timestamp, signature) {
+		panic("auth header names must be distinct")
+	}
+
+	cb.c.clientIDHeader = clientID
+	cb.c.timestampHeader = timestamp
+	cb.c.signatureHeader = signature
+	return cb
+}
+
+// WithAllowInsecureHTTP allows a DSN that uses plain http, e.g. for a local test server.
+// Otherwise Build panics if the DSN doesn't use https, so a misconfigured DSN
+// doesn't send the signed payloads in cleartext.
+// This is optional.
+func (cb *ClientBuilder) WithAllowInsecureHTTP() *ClientBuilder {
+	cb.c.allowInsecureHTTP = true
+	return cb
+}
+
+// WithName sets a name that tells the client apart from other clients in the same process,
+// e.g. the ones of different games or regions. It is part of the Stats and the Config of the
+// client, and it is sent in the x-client-name header of the requests.
+// Default: N/A, the client is unnamed and the header isn't sent
+// This is optional.
+func (cb *ClientBuilder) WithName(name string) *ClientBuilder {
+	cb.c.name = name
+	return cb
+}
+
 // WithClientID sets the Earn Alliance client ID.
 // Default: N/A
 // This is required.
@@ -170,8 +1029,53 @@ func (cb *ClientBuilder) WithGameID(gameID string) *ClientBuilder {
 	return cb
 }
 
+// validateOptions panics if options contradict each other, naming the options.
+func (c *Client) validateOptions() {
+	if c.retryWaitMin > c.retryWaitMax {
+		panic("retry wait min cannot be greater than retry wait max")
+	}
+
+	if c.minFlushBatch > c.batchSize {
+		panic("WithMinFlushBatch cannot be greater than WithBatchSize, or a full batch waits for the cooldown")
+	}
+
+	if c.flushDeadline > 0 && c.responseHeaderTimeout >= c.flushDeadline {
+		panic("WithResponseHeaderTimeout must be less than WithFlushDeadline, or it never times out")
+	}
+
+	if c.strictResponseParsing && c.responseParser != nil {
+		panic("WithStrictResponseParsing has no effect with a response parser set via WithResponseParser")
+	}
+
+	if c.payloadEncoding == PayloadEncodingNDJSON {
+		if c.spoolPath != "" {
+			panic("WithOfflineSpool can't spool the payloads of PayloadEncodingNDJSON")
+		}
+		if c.omitEmptyArrays {
+			panic("WithOmitEmptyArrays has no effect with PayloadEncodingNDJSON")
+		}
+	}
+
+	// These options configure the default transport, a custom one would ignore them
+	if c.transport != nil {
+		if c.responseHeaderTimeout > 0 {
+			panic("WithResponseHeaderTimeout has no effect with a custom transport set via WithTransport")
+		}
+		if c.httpTap != nil {
+			panic("WithHTTPTap has no effect with a custom transport set via WithTransport")
+		}
+		if c.strictResponseParsing {
+			panic("WithStrictResponseParsing has no effect with a custom transport set via WithTransport")
+		}
+		if c.responseParser != nil {
+			panic("WithResponseParser has no effect with a custom transport set via WithTransport")
+		}
+	}
+}
+
 // Build returns the client that was created via the builder and starts
-// the internal batch processing goroutine.
+// the internal batch processing goroutine, unless WithDeferredStart is set.
+// With WithPreflightCheck, it pings the API first.
 // Ensure that you have the ClientID, ClientSecret and GameID set before
 // you call this.
 func (cb *ClientBuilder) Build() *Client {
@@ -181,7 +1085,42 @@ func (cb *ClientBuilder) Build() *Client {
 		panic("missing required client options")
 	}
 
-	go c.handleBatch()
+	if u, _ := url.Parse(c.dsn); u == nil || !(u.Scheme == "https" || u.Scheme == "http" && c.allowInsecureHTTP) {
+		panic("dsn must use https, or http if allowed with WithAllowInsecureHTTP")
+	}
+
+	c.validateOptions()
+
+	if c.transport == nil {
+		c.transport = &httpTransport{
+			dsn:    c.dsn,
+			client: c.createHTTPClient(),
+			strict: c.strictResponseParsing,
+			parser: c.responseParser,
+		}
+	}
+
+	if c.maxInFlightFlushes > 0 {
+		c.flushSlots = make(chan struct{}, c.maxInFlightFlushes)
+	}
+
+	if c.preflightCheck {
+		ctx, cancel := c.flushContext(c.backgroundContext())
+		err := c.Ping(ctx)
+		cancel()
+		if isAuthError(err) {
+			panic("preflight check failed: " + err.Error())
+		}
+		if err != nil {
+			// The API might just be unreachable for now, which the client recovers from
+			c.reportError(fmt.Errorf("preflight check failed: %w", err))
+		}
+	}
+
+	if !c.deferredStart {
+		// A new client can't be started or closed yet
+		_ = c.Start()
+	}
 
 	return c
 }
@@ -1,9 +1,13 @@
 package earnalliance_test
 
 import (
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	ea "github.com/earn-alliance/earnalliance-go"
 )
@@ -79,6 +83,36 @@ func TestBuildClient(t *testing.T) {
 		ea.NewClientBuilder().WithDSN("asdasd")
 	})
 
+	t.Run("insecure dsn", func(t *testing.T) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				t.Fatal("panic was expected")
+			}
+			if !strings.Contains(err.(string), "dsn must use https") {
+				t.Fatal("unexpected panic", err.(string))
+			}
+		}()
+
+		ea.NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithDSN("http://localhost:8080/events").
+			Build()
+	})
+
+	t.Run("allowed insecure dsn", func(t *testing.T) {
+		client := ea.NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithDSN("http://localhost:8080/events").
+			WithAllowInsecureHTTP().
+			Build()
+		client.Close()
+	})
+
 	t.Run("missing any", func(t *testing.T) {
 		clientID := os.Getenv("ALLIANCE_CLIENT_ID")
 		clientSecret := os.Getenv("ALLIANCE_CLIENT_SECRET")
@@ -101,3 +135,267 @@ func TestBuildClient(t *testing.T) {
 		ea.NewClientBuilder().Build()
 	})
 }
+
+func TestContradictoryOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		builder func() *ea.ClientBuilder
+		panic   string
+	}{
+		{
+			name: "retry waits",
+			builder: func() *ea.ClientBuilder {
+				return ea.NewClientBuilder().WithRetryWaitMin(time.Second).WithRetryWaitMax(time.Millisecond)
+			},
+			panic: "retry wait min cannot be greater than retry wait max",
+		},
+		{
+			name: "min flush batch and batch size",
+			builder: func() *ea.ClientBuilder {
+				return ea.NewClientBuilder().WithBatchSize(10).WithMinFlushBatch(11)
+			},
+			panic: "WithMinFlushBatch cannot be greater than WithBatchSize",
+		},
+		{
+			name: "min flush batch and default batch size",
+			builder: func() *ea.ClientBuilder {
+				return ea.NewClientBuilder().WithMinFlushBatch(1000)
+			},
+			panic: "WithMinFlushBatch cannot be greater than WithBatchSize",
+		},
+		{
+			name: "response header timeout and flush deadline",
+			builder: func() *ea.ClientBuilder {
+				return ea.NewClientBuilder().WithResponseHeaderTimeout(time.Minute).WithFlushDeadline(time.Second)
+			},
+			panic: "WithResponseHeaderTimeout must be less than WithFlushDeadline",
+		},
+		{
+			name: "response header timeout and custom transport",
+			builder: func() *ea.ClientBuilder {
+				return ea.NewClientBuilder().WithResponseHeaderTimeout(time.Second).WithTransport(ea.NewMemoryTransport())
+			},
+			panic: "WithResponseHeaderTimeout has no effect with a custom transport",
+		},
+		{
+			name: "http tap and custom transport",
+			builder: func() *ea.ClientBuilder {
+				return ea.NewClientBuilder().WithHTTPTap(func(*http.Request, *http.Response, error) {}).WithTransport(ea.NewMemoryTransport())
+			},
+			panic: "WithHTTPTap has no effect with a custom transport",
+		},
+		{
+			name: "strict response parsing and custom transport",
+			builder: func() *ea.ClientBuilder {
+				return ea.NewClientBuilder().WithStrictResponseParsing(true).WithTransport(ea.NewMemoryTransport())
+			},
+			panic: "WithStrictResponseParsing has no effect with a custom transport",
+		},
+		{
+			name: "response parser and custom transport",
+			builder: func() *ea.ClientBuilder {
+				return ea.NewClientBuilder().WithResponseParser(func(int, []byte) error { return nil }).WithTransport(ea.NewMemoryTransport())
+			},
+			panic: "WithResponseParser has no effect with a custom transport",
+		},
+		{
+			name: "strict response parsing and response parser",
+			builder: func() *ea.ClientBuilder {
+				return ea.NewClientBuilder().WithStrictResponseParsing(true).WithResponseParser(func(int, []byte) error { return nil })
+			},
+			panic: "WithStrictResponseParsing has no effect with a response parser",
+		},
+		{
+			name: "ndjson and offline spool",
+			builder: func() *ea.ClientBuilder {
+				return ea.NewClientBuilder().WithPayloadEncoding(ea.PayloadEncodingNDJSON).WithOfflineSpool("spool.ndjson")
+			},
+			panic: "WithOfflineSpool can't spool the payloads of PayloadEncodingNDJSON",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				err := recover()
+				if err == nil {
+					t.Fatal("panic was expected")
+				}
+				if !strings.Contains(err.(string), tt.panic) {
+					t.Fatal("unexpected panic", err.(string))
+				}
+			}()
+
+			tt.builder().WithClientID("a").WithClientSecret("b").WithGameID("c").Build()
+		})
+	}
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	var events []string
+
+	client := ea.NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithTransport(ea.NewMemoryTransport()).
+		WithOnStart(func() { events = append(events, "start") }).
+		WithOnStop(func() { events = append(events, "stop") }).
+		Build()
+
+	if len(events) != 1 || events[0] != "start" {
+		t.Fatal("start hook wasn't called by Build", events)
+	}
+
+	client.Close()
+	client.Close()
+
+	if len(events) != 2 || events[1] != "stop" {
+		t.Fatal("stop hook wasn't called once by Close", events)
+	}
+}
+
+func TestDeferredStart(t *testing.T) {
+	var events []string
+	transport := ea.NewMemoryTransport()
+
+	client := ea.NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithBatchSize(1).
+		WithTransport(transport).
+		WithDeferredStart().
+		WithOnStart(func() { events = append(events, "start") }).
+		WithOnStop(func() { events = append(events, "stop") }).
+		Build()
+
+	// The full batch waits for the batch handler
+	client.Track("asd", "kill", nil, nil)
+	time.Sleep(50 * time.Millisecond)
+	if len(events) != 0 || len(transport.Payloads()) != 0 {
+		t.Fatal("client was started by Build", events)
+	}
+
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Start(); err != ea.ErrClientStarted {
+		t.Fatal("second start didn't return ErrClientStarted", err)
+	}
+	if len(events) != 1 || events[0] != "start" {
+		t.Fatal("start hook wasn't called once by Start", events)
+	}
+
+	for i := 0; len(transport.Payloads()) == 0; i++ {
+		if i == 100 {
+			t.Fatal("batch wasn't sent after Start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client.Close()
+	if err := client.Start(); err != ea.ErrClientClosed {
+		t.Fatal("start after close didn't return ErrClientClosed", err)
+	}
+}
+
+func TestDeferredStartClose(t *testing.T) {
+	var events []string
+
+	client := ea.NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithTransport(ea.NewMemoryTransport()).
+		WithDeferredStart().
+		WithOnStop(func() { events = append(events, "stop") }).
+		Build()
+
+	// Closing a client that was never started doesn't block
+	client.Close()
+	if len(events) != 0 {
+		t.Fatal("stop hook was called without start", events)
+	}
+}
+
+func TestPreflightCheck(t *testing.T) {
+	var bodies []string
+	accept := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if !accept {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid credentials"}`))
+			return
+		}
+		w.Write([]byte(`{"message":"OK"}`))
+	}))
+	defer server.Close()
+
+	// Nobody reads the error channel, so Build would block on a reported error
+	errChan := make(chan error)
+	build := func() *ea.Client {
+		return ea.NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithDSN(server.URL).
+			WithAllowInsecureHTTP().
+			WithErrorChannel(errChan).
+			WithPreflightCheck(true).
+			Build()
+	}
+
+	built := make(chan *ea.Client, 1)
+	go func() { built <- build() }()
+	var client *ea.Client
+	select {
+	case client = <-built:
+	case err := <-errChan:
+		t.Fatal("unexpected error", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Build blocked")
+	}
+	client.Close()
+	if len(bodies) != 1 || bodies[0] != `{"gameId":"c","events":[],"identifiers":[]}` {
+		t.Fatal("unexpected preflight requests", bodies)
+	}
+
+	accept = false
+	defer func() {
+		err := recover()
+		if err == nil {
+			t.Fatal("panic was expected")
+		}
+		if !strings.Contains(err.(string), "preflight check failed: server returned error: 401: invalid credentials") {
+			t.Fatal("unexpected panic", err.(string))
+		}
+	}()
+	build()
+}
+
+func TestPreflightCheckUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	errChan := make(chan error, 1)
+	client := ea.NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithDSN(server.URL).
+		WithAllowInsecureHTTP().
+		WithoutRetry().
+		WithErrorChannel(errChan).
+		WithPreflightCheck(true).
+		Build()
+	defer client.Close()
+
+	// Build doesn't panic, and the error is sent to the error channel
+	err := <-errChan
+	if !strings.Contains(err.Error(), "preflight check failed: failed to do request") {
+		t.Fatal("unexpected error", err)
+	}
+}
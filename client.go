@@ -2,14 +2,21 @@ package earnalliance
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
+	"maps"
+	"runtime/debug"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -21,30 +28,170 @@ type (
 	// It contains an event queue which sends batchSize (can be set via options)
 	// events to the API. This queue is FIFO.
 	Client struct {
-		// Initialization args
-		batchSize     int
-		gameID        string
-		clientID      string
-		clientSecret  string
-		dsn           string
-		httpClient    httpClient
-		errorChan     chan error
-		flushInterval time.Duration
-		flushCooldown time.Duration
+		// Initialization args, batchSize and flushInterval
+		// can be changed at runtime while holding queueLock
+		options
 
 		// Runtime fields
+		// Guards started, so the batch handler is never started after Close
+		lifecycleLock    sync.Mutex
+		started          bool
 		flushLock        sync.Mutex
 		lastFlush        time.Time
-		flushWaiting     *time.Timer
+		flushWaiting     Timer
 		stopBatchHandler chan struct{}
+		closed           atomic.Bool
+		flushSignal      chan FlushTrigger
+		// Signals the batch handler to reset its ticker to the current flushInterval
+		flushIntervalReset chan struct{}
+		// Limits the number of flushes in flight, nil means unlimited
+		flushSlots   chan struct{}
+		flushPending atomic.Bool
+		// The trigger of the latest flush that was coalesced while flushPending was set
+		pendingTrigger atomic.Int32
+		// Notified with the result of the next batch that is sent
+		flushWaitersLock sync.Mutex
+		flushWaiters     []chan error
+		spoolLock        sync.Mutex
+		// Counts what the self telemetry reports
+		telemetryLock sync.Mutex
+		telemetry     telemetry
+		// The latencies of the sends, the bytes sent, the failed sends and the dropped items, for Stats
+		latency      latencyHistogram
+		bytesSent    atomic.Uint64
+		sendFailures atomic.Uint64
+		dropped      atomic.Uint64
+		// The keys of the events submitted by TrackOnce
+		once onceMarkers
+		// The sessions whose start game event was submitted by StartGameSession
+		sessions onceMarkers
+		// The IDs of the active rounds, with WithUniqueRoundIDs
+		rounds activeRounds
+		// Stops the goroutine that emits the stats, which closes metricsDone once it returned
+		stopMetrics chan struct{}
+		metricsDone chan struct{}
 
 		queueLock       sync.Mutex
-		eventQueue      []event
-		identifierQueue []identifier
+		eventQueue      []Event
+		identifierQueue []UserIdentifiers
 	}
 
-	httpClient interface {
-		Do(req *http.Request) (*http.Response, error)
+	// options are the initialization args of a client, which are set by the builder.
+	options struct {
+		batchSize    int
+		gameID       string
+		clientID     string
+		clientSecret string
+		dsn          string
+		transport    Transport
+		httpTap      HTTPTap
+		errorChan    chan error
+		// The maximum number of retries, 0 means retries are disabled
+		maxRetryAttempts int
+		retryWaitMin     time.Duration
+		retryWaitMax     time.Duration
+		retryJitter      bool
+		// The maximum time to wait for the response headers, 0 means no limit
+		responseHeaderTimeout time.Duration
+		flushInterval         time.Duration
+		flushCooldown         time.Duration
+		// The source of time of the flush cooldown
+		clock Clock
+		// Applied to the names of tracked events
+		eventNameTransform func(string) string
+		// Added to every event
+		globalTraits Traits
+		// Whether whitespace is trimmed from string trait values
+		trimTraitStrings  bool
+		signer            Signer
+		signatureEncoding SignatureEncoding
+		marshaler         func(v any) ([]byte, error)
+		// Whether full batches are sent by the batch handler instead of the caller
+		asyncBatchFlush bool
+		// 0 means unlimited
+		maxInFlightFlushes int
+		queueObserver      func(kind QueueKind, depth int)
+		onStart            func()
+		onStop             func()
+		errorEventName     string
+		// The name of the event submitted by StartGame
+		startGameEventName string
+		// The schema of events that aren't tracked with one
+		defaultSchema   string
+		errorStackTrace bool
+		onDrop          func(reason DropReason, events []Event, identifiers []UserIdentifiers)
+		// Identifier updates that are queued for longer are dropped, 0 means no limit
+		identifierMaxAge time.Duration
+		// Formats the values of the events when they are marshalled
+		valueFormatter   func(value *int) any
+		batchComposition BatchComposition
+		// Failed payloads are appended to this file, if set
+		spoolPath             string
+		strictResponseParsing bool
+		responseParser        ResponseParser
+		// Supplies the context of the flushes that aren't passed one
+		baseContext func() context.Context
+		// Whether Build leaves starting the batch handler to Start
+		deferredStart bool
+		// Whether empty arrays are left out of the payload
+		omitEmptyArrays bool
+		// Whether the DSN may use plain http
+		allowInsecureHTTP bool
+		// The maximum time a flush may take, including all retries, 0 means no limit
+		flushDeadline time.Duration
+		// The maximum number of batches a flush sends, 0 means unlimited
+		maxBatchesPerFlush int
+		// Whether the client queues events about its own health
+		selfTelemetry       bool
+		selfTelemetryUserID string
+		// Events for which it returns false are never queued
+		eventFilter func(e Event) bool
+		// Whether the event filter applies to StartGame
+		filterStartGame bool
+		// The names of the authentication headers
+		clientIDHeader  string
+		timestampHeader string
+		signatureHeader string
+		// The source of the time of the events
+		timeFunc func() time.Time
+		// Tells the client apart from others in the same process, empty if unnamed
+		name string
+		// Whether removals that are already queued are left out of identifier updates
+		coalesceIdentifierRemovals bool
+		// Whether empty identifiers must be created by RemoveIdentifier
+		strictIdentifiers bool
+		// The queue that replaces the in-memory one, nil if not set
+		queue Queue
+		// The time between the snapshots of the stats passed to metricsCallback, 0 if disabled
+		metricsInterval time.Duration
+		metricsCallback func(Stats)
+		// The key of the events submitted by TrackOnce, and for how long and how many keys are remembered
+		trackOnceKey  func(userID string, eventName string) string
+		onceRetention time.Duration
+		onceMaxKeys   int
+		// Whether StartRound reports rounds with the ID of an active round
+		uniqueRoundIDs bool
+		// The size of a marshalled payload above which onPayloadSizeWarning is called, 0 if disabled
+		payloadSizeWarning   int
+		onPayloadSizeWarning func(size int)
+		// The number of queued items below which a flush after the cooldown waits another cooldown
+		minFlushBatch int
+		// The validators of the identifier fields, and whether an update
+		// with an invalid field is rejected instead of just the field
+		identifierValidators     map[IdentifierField]func(value string) error
+		rejectInvalidIdentifiers bool
+		// Called after every flush of the queue with what triggered it
+		onFlush func(trigger FlushTrigger, err error)
+		// For how long StartGameSession suppresses the start game event of the same session
+		startGameSessionTimeout time.Duration
+		// How long Close has to send what is queued, 0 if it doesn't send it
+		shutdownTimeout time.Duration
+		// How the batches are encoded in the body of the requests
+		payloadEncoding PayloadEncoding
+		// Whether Build pings the API before it returns the client
+		preflightCheck bool
+		// Whether SetIdentifiers flushes the queue
+		flushOnIdentifier bool
 	}
 
 	// Round is a nice way of grouping some events together.
@@ -53,24 +200,75 @@ type (
 	// You can also create the Round with some traits
 	// and these traits will be copied to the events.
 	Round struct {
-		id     string
-		traits Traits
-		c      *Client
+		id            string
+		correlationID string
+		traits        Traits
+		c             *Client
 	}
 
-	event struct {
+	roundContextKey struct{}
+
+	// Event is an event as it is sent to the API.
+	// Events are created by Track and the other tracking methods of the client.
+	Event struct {
 		UserID string `json:"userId"`
 		// ISO format timestamp
 		Time    string `json:"time"`
 		Event   string `json:"event"`
 		GroupID string `json:"groupId"`
-		Traits  Traits `json:"traits,omitempty"`
-		Value   *int   `json:"value,omitempty"`
+		// The cross-system trace ID of the round of the event, left out if empty
+		CorrelationID string `json:"correlationId,omitempty"`
+		Traits        Traits `json:"traits,omitempty"`
+		// Numeric measures of the event, like its damage or duration
+		Metrics map[string]float64 `json:"metrics,omitempty"`
+		// The version of the event taxonomy the event conforms to, left out if empty
+		Schema string `json:"schema,omitempty"`
+		Value  *int   `json:"value,omitempty"`
+
+		priority Priority
 	}
 
-	identifier struct {
+	// UserIdentifiers is an update of a user's identifiers as it is sent to the API.
+	// These are created by SetIdentifiers.
+	UserIdentifiers struct {
 		UserID string `json:"userId"`
 		Identifiers
+
+		queuedAt time.Time
+	}
+
+	// payload is the request body sent to the API. It is a struct rather
+	// than a map so it can be encoded without the intermediate allocations,
+	// and so its fields are always encoded in the same order. Together with the
+	// sorted keys of Traits, the same batch always produces the same bytes,
+	// which lets anyone recompute the signature of a captured payload.
+	payload struct {
+		GameID      string            `json:"gameId"`
+		Events      []Event           `json:"events"`
+		Identifiers []UserIdentifiers `json:"identifiers"`
+	}
+
+	// formattedPayload is the payload with the values of its events
+	// formatted by the value formatter. Its fields are in the same order.
+	formattedPayload struct {
+		GameID      string            `json:"gameId"`
+		Events      []formattedEvent  `json:"events"`
+		Identifiers []UserIdentifiers `json:"identifiers"`
+	}
+
+	// sparsePayload is the payload with its empty arrays left out, for WithOmitEmptyArrays.
+	// Events holds either []Event or []formattedEvent. Its fields are in the same order.
+	sparsePayload struct {
+		GameID      string            `json:"gameId"`
+		Events      any               `json:"events,omitempty"`
+		Identifiers []UserIdentifiers `json:"identifiers,omitempty"`
+	}
+
+	// formattedEvent is an event whose Value shadows the value of the embedded event,
+	// so it is encoded in the same position.
+	formattedEvent struct {
+		Event
+		Value any `json:"value,omitempty"`
 	}
 
 	// Identifiers contains the current identifiers supported by Earn Alliance.
@@ -90,19 +288,176 @@ type (
 	}
 
 	// Traits is a JSON object.
+	// Its keys are sorted when it is encoded by the default marshaler.
 	Traits map[string]any
+
+	// Signer signs the body of a request, the result is sent in the x-signature header.
+	// The timestamp is the Unix time in milliseconds that is sent in the x-timestamp header.
+	Signer func(clientID, clientSecret, timestamp string, body []byte) (string, error)
+
+	// SignatureEncoding is the encoding of the signature created by the default signer.
+	SignatureEncoding int
+
+	// PayloadEncoding is how the batches are encoded in the body of the requests.
+	PayloadEncoding int
+
+	// QueueKind is the kind of queue that an item was added to.
+	QueueKind int
+
+	// BatchComposition decides how many identifier updates and events go into a batch
+	// when there are more of them queued than fit into one. The order within
+	// each queue is kept, and a batch is always filled if there is enough queued.
+	BatchComposition int
+
+	// FlushOutcome is what a flush did, see Flush for the details of each case.
+	FlushOutcome int
+
+	// FlushTrigger is what triggered a flush, which is passed to the flush callback.
+	FlushTrigger int
+
+	// DropReason is the reason why events or identifier updates were dropped without being sent.
+	DropReason int
+
+	// Priority is the priority of an event. Events with a higher priority are sent
+	// before the events with a lower priority, regardless of when they were queued.
+	Priority int
+)
+
+const (
+	// PriorityNormal is the priority of all events, unless they are tracked with TrackPriority.
+	PriorityNormal Priority = iota
+	// PriorityHigh is for critical events, like purchases, that shouldn't wait behind other events.
+	PriorityHigh
+)
+
+const (
+	// BatchCompositionIdentifiersFirst fills a batch with identifier updates,
+	// and the space that is left with events.
+	BatchCompositionIdentifiersFirst BatchComposition = iota
+	// BatchCompositionEventsFirst fills a batch with events,
+	// and the space that is left with identifier updates.
+	BatchCompositionEventsFirst
+	// BatchCompositionInterleaved takes identifier updates and events alternately,
+	// starting with an identifier update, so each gets half of the batch if both are queued.
+	BatchCompositionInterleaved
+)
+
+const (
+	// FlushOutcomeSent means the cooldown period had passed, so a batch was sent right away,
+	// unless the queue was empty.
+	FlushOutcomeSent FlushOutcome = iota
+	// FlushOutcomeScheduled means the cooldown period is active, so a goroutine
+	// was started that sends a batch once it is over. It also means that the maximum
+	// number of flushes set via WithMaxInFlightFlushes are in flight, so a batch is sent
+	// once one of them is done.
+	FlushOutcomeScheduled
+	// FlushOutcomeSkipped means a batch is already scheduled to be sent once the cooldown
+	// period is over, or that the client is closed, so nothing was done.
+	FlushOutcomeSkipped
+)
+
+const (
+	// DropReasonUnmarshalable is for events that can't be marshalled, e.g. because of their traits.
+	DropReasonUnmarshalable DropReason = iota
+	// DropReasonPurged is for items removed from the queue by PurgeUser or PurgeQueue.
+	DropReasonPurged
+	// DropReasonExpired is for identifier updates that were queued for longer than
+	// the maximum age set with WithIdentifierMaxAge.
+	DropReasonExpired
 )
 
+const (
+	// FlushTriggerExplicit is for the flushes requested by the caller, e.g. via Flush or TriggerFlush.
+	FlushTriggerExplicit FlushTrigger = iota
+	// FlushTriggerBatchSize is for the flushes of a queue that hit the batch size.
+	FlushTriggerBatchSize
+	// FlushTriggerInterval is for the flushes of the flush interval.
+	FlushTriggerInterval
+	// FlushTriggerIdentifier is for the flushes after identifiers were submitted,
+	// unless disabled with WithFlushOnIdentifier.
+	FlushTriggerIdentifier
+	// FlushTriggerClose is for the flush of Close, with WithShutdownTimeout.
+	FlushTriggerClose
+)
+
+// String returns the name of the trigger, e.g. for logging.
+func (t FlushTrigger) String() string {
+	switch t {
+	case FlushTriggerExplicit:
+		return "explicit"
+	case FlushTriggerBatchSize:
+		return "batch size"
+	case FlushTriggerInterval:
+		return "interval"
+	case FlushTriggerIdentifier:
+		return "identifier"
+	case FlushTriggerClose:
+		return "close"
+	default:
+		return fmt.Sprintf("FlushTrigger(%d)", int(t))
+	}
+}
+
+const (
+	// QueueKindEvent is the queue of events.
+	QueueKindEvent QueueKind = iota
+	// QueueKindIdentifier is the queue of identifier updates.
+	QueueKindIdentifier
+)
+
+const (
+	// PayloadEncodingJSON encodes a batch as a single JSON object, which is what the API expects.
+	PayloadEncodingJSON PayloadEncoding = iota
+	// PayloadEncodingNDJSON encodes a batch as newline delimited JSON, e.g. for log ingestion
+	// endpoints. Each line is an object with the game ID, and either the event under the "event" key,
+	// or the identifier update under the "identifiers" key. The events come first.
+	// The requests have the application/x-ndjson content type.
+	PayloadEncodingNDJSON
+)
+
+const (
+	// SignatureEncodingHex encodes the signature as lowercase hex, which is what the API expects.
+	SignatureEncodingHex SignatureEncoding = iota
+	// SignatureEncodingBase64 encodes the signature as standard base64 with padding.
+	SignatureEncodingBase64
+)
+
+// StartGameEvent is the default name of the event submitted by StartGame,
+// which can be changed via WithStartGameEventName.
+const StartGameEvent = "START_GAME"
+
 const (
 	defaultMaxRetryAttempts = 5
+	defaultRetryWaitMin     = 1 * time.Second
+	defaultRetryWaitMax     = 30 * time.Second
 	defaultBatchSize        = 100
 	defaultFlushInterval    = 30 * time.Second
 	defaultFlushCooldown    = 10 * time.Second
 	defaultDSN              = "https://events.earnalliance.com/v2/custom-events"
 
-	startGameEvent = "START_GAME"
+	defaultClientIDHeader  = "x-client-id"
+	defaultTimestampHeader = "x-timestamp"
+	defaultSignatureHeader = "x-signature"
+
+	defaultErrorEventName = "ERROR"
+	errorMessageTrait     = "message"
+	errorStackTrait       = "stack"
+
+	maxPooledBufferSize = 1 << 20
 )
 
+// ErrClientClosed is returned, or sent to the error channel, when the client is used after Close.
+var ErrClientClosed = errors.New("client is closed")
+
+// ErrClientStarted is returned by Start when the client was already started.
+var ErrClientStarted = errors.New("client is already started")
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
 // Flush flushes the event queue.
 // We can only rely on this returning an error or not in case #1 below.
 // Other cases are asynchronous and won't return an error.
@@ -116,52 +471,303 @@ const (
 // 3. The cooldown is active & Flush has been called during this period:
 // - Then this simply returns nil and the events will be sent by the goroutine
 // that was created in case #2.
+// With WithMinFlushBatch, case #1 is handled like case #2 while fewer items are queued.
+// Sending drains the queue in as many batches as needed. If some of them fail, their errors
+// are joined, and their items are queued again to be sent with the next flush.
+// It returns ErrClientClosed if the client is closed.
+// Use FlushWithOutcome to find out which of the cases happened.
 func (c *Client) Flush() error {
+	_, err := c.FlushWithOutcome()
+	return err
+}
+
+// FlushWithOutcome is like Flush, but it also returns which of the three cases
+// described by Flush happened.
+func (c *Client) FlushWithOutcome() (FlushOutcome, error) {
+	if c.closed.Load() {
+		return FlushOutcomeSkipped, ErrClientClosed
+	}
+	return c.flushWithOutcome(FlushTriggerExplicit)
+}
+
+// flush is Flush without the check whether the client is closed, for the flushes
+// of the client itself, which can still happen while it's being closed.
+func (c *Client) flush(trigger FlushTrigger) error {
+	_, err := c.flushWithOutcome(trigger)
+	return err
+}
+
+func (c *Client) flushWithOutcome(trigger FlushTrigger) (FlushOutcome, error) {
+	// Without a cooldown every flush is sent right away, so no waiter is ever created
+	if c.flushCooldown == 0 {
+		return c.processWithOutcome(c.backgroundContext(), trigger)
+	}
+
 	c.flushLock.Lock()
-	if time.Since(c.lastFlush) >= c.flushCooldown {
-		c.lastFlush = time.Now()
-		c.flushLock.Unlock()
-		return c.process()
+	leftover := c.flushCooldown - c.clock.Now().Sub(c.lastFlush)
+	if leftover <= 0 {
+		if !c.belowMinFlushBatch() {
+			if c.flushWaiting != nil && c.flushWaiting.Stop() {
+				c.flushWaiting = nil
+			}
+			c.lastFlush = c.clock.Now()
+			c.flushLock.Unlock()
+			return c.processWithOutcome(c.backgroundContext(), trigger)
+		}
+		// Give the queue one cooldown to fill up
+		leftover = c.flushCooldown
 	}
 
 	// If there is already a goroutine waiting to flush
 	if c.flushWaiting != nil {
 		c.flushLock.Unlock()
-		return nil
+		return FlushOutcomeSkipped, nil
 	} else {
 		// Create a goroutine that will flush when the cooldown is done
-		leftover := c.flushCooldown - time.Since(c.lastFlush)
-		c.flushWaiting = time.AfterFunc(leftover, func() {
+		c.flushWaiting = c.clock.AfterFunc(leftover, func() {
 			c.flushLock.Lock()
-			c.lastFlush = time.Now()
+			c.lastFlush = c.clock.Now()
 			c.flushWaiting = nil
 			c.flushLock.Unlock()
-			c.doProcess()
+			c.doProcess(trigger)
+			// The client was closed while the batch was being sent
+			if c.closed.Load() {
+				return
+			}
+
+			// Anything that didn't fit into the batch, e.g. identifiers that were
+			// queued while the batch was being sent, is flushed after the next
+			// cooldown instead of waiting for the flush interval.
+			c.queueLock.Lock()
+			queueSize := c.queueSize()
+			c.queueLock.Unlock()
+			if queueSize > 0 {
+				c.reportError(c.flush(trigger))
+			}
 		})
 		c.flushLock.Unlock()
-		return nil
+		return FlushOutcomeScheduled, nil
+	}
+}
+
+// belowMinFlushBatch returns whether fewer items than the minimum flush batch are queued.
+func (c *Client) belowMinFlushBatch() bool {
+	if c.minFlushBatch == 0 {
+		return false
+	}
+
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+	return c.queueSize() < c.minFlushBatch
+}
+
+// TriggerFlush wakes up the batch handler goroutine to send a batch right away,
+// ignoring the flush cooldown, e.g. to flush at times decided by an external scheduler.
+// It doesn't wait for the batch to be sent, use WaitForFlush for that. Triggers that happen
+// while the batch handler is still busy with a previous one are coalesced into one flush.
+// Errors are sent to the error channel. It does nothing if the client is closed.
+func (c *Client) TriggerFlush() {
+	if c.closed.Load() {
+		return
 	}
+	c.signalFlush(FlushTriggerExplicit)
 }
 
-// Track submits an event to the event queue. If the event queue
-// hits the batch size limit, then Flush will be called.
+// FlushBlocking is like Flush, but if the cooldown period is active, it waits for it
+// to end and sends the events itself instead of leaving that to a goroutine, so the
+// error of sending them is returned. This takes over a flush that is already waiting
+// for the cooldown. If ctx is done before the cooldown ends, its error is returned.
+// It returns ErrClientClosed if the client is closed.
+func (c *Client) FlushBlocking(ctx context.Context) error {
+	if c.closed.Load() {
+		return ErrClientClosed
+	}
+
+	if c.flushCooldown == 0 {
+		return c.processWaiting(ctx, FlushTriggerExplicit)
+	}
+
+	tookOver := false
+	for {
+		c.flushLock.Lock()
+		if c.flushWaiting != nil && c.flushWaiting.Stop() {
+			c.flushWaiting = nil
+			tookOver = true
+		}
+		leftover := c.flushCooldown - c.clock.Now().Sub(c.lastFlush)
+		if leftover <= 0 {
+			c.lastFlush = c.clock.Now()
+			c.flushLock.Unlock()
+			return c.processWaiting(ctx, FlushTriggerExplicit)
+		}
+		c.flushLock.Unlock()
+
+		// Another flush may start in the meantime, in which case this waits for the next cooldown
+		done := make(chan struct{})
+		timer := c.clock.AfterFunc(leftover, func() { close(done) })
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			if tookOver {
+				// Hand the flush back to a goroutine
+				c.reportError(c.flush(FlushTriggerExplicit))
+			}
+			return ctx.Err()
+		case <-done:
+		}
+	}
+}
+
+// ForceFlush sends the queued items right now, ignoring the flush cooldown, and returns the
+// error of sending them, e.g. on shutdown. A flush that is waiting for the cooldown is canceled,
+// and the cooldown starts over. A waiting flush whose cooldown just ended may still run, but it
+// only sends what is queued after ForceFlush took the items. It returns ErrClientClosed if the
+// client is closed.
+func (c *Client) ForceFlush(ctx context.Context) error {
+	if c.closed.Load() {
+		return ErrClientClosed
+	}
+
+	c.flushLock.Lock()
+	// If the timer already fired, its goroutine clears flushWaiting itself
+	if c.flushWaiting != nil && c.flushWaiting.Stop() {
+		c.flushWaiting = nil
+	}
+	c.lastFlush = c.clock.Now()
+	c.flushLock.Unlock()
+
+	return c.processWaiting(ctx, FlushTriggerExplicit)
+}
+
+// Track submits an event to the event queue. The traits are combined with the global traits,
+// the traits passed to this function overwrite the global traits with the same keys.
+// If the event queue hits the batch size limit, the batch handler goroutine is woken up to send it.
 func (c *Client) Track(userID string, eventName string, value *int, traits Traits) {
-	c.appendEvent(&event{
+	c.appendEvent(&Event{
 		Value:  value,
 		UserID: userID,
-		Traits: traits,
-		Event:  eventName,
-		Time:   time.Now().Format(time.RFC3339),
+		Traits: c.eventTraits(nil, traits),
+		Event:  c.eventName(eventName),
+		Time:   c.eventTime(),
+	})
+}
+
+// TrackPriority submits an event to the event queue just like Track, but with the priority p.
+// The event is placed in front of all queued events with a lower priority,
+// so that it is sent with the next batch even when the queue is long.
+func (c *Client) TrackPriority(userID string, eventName string, value *int, traits Traits, p Priority) {
+	c.appendEvent(&Event{
+		Value:    value,
+		UserID:   userID,
+		Traits:   c.eventTraits(nil, traits),
+		Event:    c.eventName(eventName),
+		Time:     c.eventTime(),
+		priority: p,
+	})
+}
+
+// TrackRaw submits an event to the event queue exactly as it is given, e.g. to keep the
+// original time and group ID of events bridged from another system. The event name transform,
+// the global traits and the default schema are not applied, but the event filter is.
+// The user ID, the event name and the time are still required, and the time must be
+// in the RFC 3339 format.
+// If the event queue hits the batch size limit, the batch will be sent in the background.
+// It returns ErrClientClosed if the client is closed.
+func (c *Client) TrackRaw(e Event) error {
+	if e.UserID == "" {
+		return errors.New("event user id cannot be empty")
+	}
+	if e.Event == "" {
+		return errors.New("event name cannot be empty")
+	}
+	if _, err := time.Parse(time.RFC3339, e.Time); err != nil {
+		return fmt.Errorf("invalid event time: %w", err)
+	}
+	if c.closed.Load() {
+		return ErrClientClosed
+	}
+
+	e.priority = PriorityNormal
+	if c.eventFilter != nil && !c.eventFilter(e) {
+		return nil
+	}
+	if c.queueEvent(&e) {
+		c.batchFull()
+	}
+	return nil
+}
+
+// TrackWithSchema submits an event to the event queue just like Track,
+// but it conforms to schema instead of the default schema set via WithDefaultSchema.
+func (c *Client) TrackWithSchema(schema string, userID string, eventName string, value *int, traits Traits) {
+	c.appendEvent(&Event{
+		Value:  value,
+		UserID: userID,
+		Traits: c.eventTraits(nil, traits),
+		Event:  c.eventName(eventName),
+		Time:   c.eventTime(),
+		Schema: schema,
+	})
+}
+
+// TrackMetrics submits an event to the event queue just like Track, but instead of a single
+// value, it carries several numeric measures, e.g. its damage, distance and duration.
+// They are sent as a dedicated metrics object, so they are treated as measures
+// rather than traits. Metrics that are NaN or infinite can't be sent,
+// so the event is dropped when it is marshalled.
+func (c *Client) TrackMetrics(userID string, eventName string, metrics map[string]float64, traits Traits) {
+	c.appendEvent(&Event{
+		Metrics: metrics,
+		UserID:  userID,
+		Traits:  c.eventTraits(nil, traits),
+		Event:   c.eventName(eventName),
+		Time:    c.eventTime(),
 	})
 }
 
-// StartGame submits an event with the name "START_GAME" and without any traits or value
-// to the event queue. If the event queue hits the batch size limit, then Flush will be called.
+// StartGame submits an event with the name StartGameEvent, or the one set via WithStartGameEventName,
+// and without any traits (except the global traits) or value to the event queue.
+// If the event queue hits the batch size limit, the batch will be sent in the background.
+// The event name transform is not applied to the reserved name.
 func (c *Client) StartGame(userID string) {
-	c.appendEvent(&event{
+	c.startGame(userID, nil)
+}
+
+// startGame submits the start game event with the traits.
+func (c *Client) startGame(userID string, traits Traits) {
+	var filter func(e Event) bool
+	if c.filterStartGame {
+		filter = c.eventFilter
+	}
+
+	c.appendFilteredEvent(&Event{
+		UserID: userID,
+		Traits: c.eventTraits(nil, traits),
+		Event:  c.startGameEventName,
+		Time:   c.eventTime(),
+	}, filter)
+}
+
+// TrackError submits an event for err to the event queue. Its name is "ERROR" by default,
+// which can be changed via WithErrorEventName, and the traits contain the message of the
+// error under the "message" key, and the stack trace under the "stack" key if WithErrorStackTrace
+// is enabled. These keys overwrite the traits with the same keys. Nil errors are ignored.
+// The event name transform is not applied to the error event name.
+func (c *Client) TrackError(userID string, err error, traits Traits) {
+	if err == nil {
+		return
+	}
+
+	errorTraits := Traits{errorMessageTrait: err.Error()}
+	if c.errorStackTrace {
+		errorTraits[errorStackTrait] = string(debug.Stack())
+	}
+
+	c.appendEvent(&Event{
 		UserID: userID,
-		Event:  startGameEvent,
-		Time:   time.Now().Format(time.RFC3339),
+		Traits: c.eventTraits(nil, combineTraits(traits, errorTraits)),
+		Event:  c.errorEventName,
+		Time:   c.eventTime(),
 	})
 }
 
@@ -170,10 +776,15 @@ func (c *Client) StartGame(userID string) {
 // same keys when submitting an event.
 // If id is an empty string we will generate a fresh UUID, and the events
 // sent to this round will have their GroupID set to this UUID.
+// With WithUniqueRoundIDs, an error wrapping ErrDuplicateRoundID is sent to the error channel
+// if a round with the same id was started and not ended yet, but the round is still returned.
 func (c *Client) StartRound(id string, traits Traits) *Round {
 	if id == "" {
 		id = uuid.NewString()
 	}
+	if c.uniqueRoundIDs && !c.rounds.add(id) {
+		c.reportError(fmt.Errorf("%w: %s", ErrDuplicateRoundID, id))
+	}
 
 	return &Round{
 		c:      c,
@@ -182,221 +793,1281 @@ func (c *Client) StartRound(id string, traits Traits) *Round {
 	}
 }
 
+// StartRoundWithCorrelation creates a new Round just like StartRound, whose events also
+// have their CorrelationID set to correlationID, e.g. the trace ID of a play session that
+// is correlated across systems. Unlike the GroupID, it isn't generated if it is empty.
+func (c *Client) StartRoundWithCorrelation(id string, correlationID string, traits Traits) *Round {
+	r := c.StartRound(id, traits)
+	r.correlationID = correlationID
+	return r
+}
+
+// StartRoundContext creates a new Round just like StartRound, and returns
+// a copy of ctx that carries the round. Code that receives the context
+// can track events into the round via RoundFromContext.
+func (c *Client) StartRoundContext(ctx context.Context, id string, traits Traits) (context.Context, *Round) {
+	r := c.StartRound(id, traits)
+	return context.WithValue(ctx, roundContextKey{}, r), r
+}
+
+// RoundFromContext returns the Round carried by ctx,
+// or nil if the context wasn't created via StartRoundContext.
+func RoundFromContext(ctx context.Context) *Round {
+	r, _ := ctx.Value(roundContextKey{}).(*Round)
+	return r
+}
+
 // Track submits an event to the event queue with its GroupID set to the round's ID.
-// The traits are combined with the round's traits. The traits passed to this function
-// will overwrite the round's traits for this event when they are combined.
-// If the event queue hits the batch size limit, then Flush will be called.
+// The traits are combined with the round's traits and the global traits. The traits passed
+// to this function will overwrite the round's traits for this event when they are combined,
+// and the round's traits overwrite the global traits.
+// If the event queue hits the batch size limit, the batch will be sent in the background.
 // You can use the PointerFrom function to create the value pointer.
 func (r *Round) Track(userID string, eventName string, value *int, traits Traits) {
-	r.c.appendEvent(&event{
-		GroupID: r.id,
-		Value:   value,
-		UserID:  userID,
-		Event:   eventName,
-		Traits:  combineTraits(r.traits, traits),
-		Time:    time.Now().Format(time.RFC3339),
+	r.c.appendEvent(&Event{
+		GroupID:       r.id,
+		CorrelationID: r.correlationID,
+		Value:         value,
+		UserID:        userID,
+		Event:         r.c.eventName(eventName),
+		Traits:        r.c.eventTraits(r.traits, traits),
+		Time:          r.c.eventTime(),
 	})
 }
 
+// TrackContext submits an event to the event queue just like Track. If the event queue
+// hits the batch size limit, the batch is sent by the caller with ctx,
+// and the error of sending it is returned.
+func (r *Round) TrackContext(ctx context.Context, userID string, eventName string, value *int, traits Traits) error {
+	if r.c.closed.Load() {
+		return ErrClientClosed
+	}
+
+	e := &Event{
+		GroupID:       r.id,
+		CorrelationID: r.correlationID,
+		Value:         value,
+		UserID:        userID,
+		Event:         r.c.eventName(eventName),
+		Traits:        r.c.eventTraits(r.traits, traits),
+		Time:          r.c.eventTime(),
+	}
+	r.c.setDefaults(e)
+	if r.c.eventFilter != nil && !r.c.eventFilter(*e) {
+		return nil
+	}
+	if !r.c.queueEvent(e) {
+		return nil
+	}
+	return r.c.processWaiting(ctx, FlushTriggerBatchSize)
+}
+
+// Flush sends the queued events of the round right away, ignoring the flush cooldown,
+// e.g. to make sure they are delivered when the round ends. Other events stay queued.
+// The events that couldn't be sent are put back in the queue, and sent with a later flush.
+// It returns ErrClientClosed if the client is closed.
+func (r *Round) Flush(ctx context.Context) error {
+	if r.c.closed.Load() {
+		return ErrClientClosed
+	}
+
+	events, _ := r.c.extractQueued(func(e *Event) bool { return e.GroupID == r.id }, nil)
+	return r.c.sendBatches(ctx, events, nil)
+}
+
+// End frees the ID of the round, so that it can be used by another round with WithUniqueRoundIDs.
+// The round can still be used, but the ID isn't checked against the other rounds anymore.
+func (r *Round) End() {
+	if r.c.uniqueRoundIDs {
+		r.c.rounds.remove(r.id)
+	}
+}
+
+// FlushUser sends everything that is queued for the user right away,
+// ignoring the flush cooldown. The items of other users stay queued.
+// The items that couldn't be sent are put back in the queue, and sent with a later flush.
+func (c *Client) FlushUser(ctx context.Context, userID string) error {
+	if c.closed.Load() {
+		return ErrClientClosed
+	}
+
+	events, identifiers := c.extractQueued(
+		func(e *Event) bool { return e.UserID == userID },
+		func(i *UserIdentifiers) bool { return i.UserID == userID },
+	)
+	return c.sendBatches(ctx, events, identifiers)
+}
+
+// PurgeUser removes everything that is queued for the user without sending it.
+// The removed items are passed to the drop callback.
+func (c *Client) PurgeUser(userID string) {
+	events, identifiers := c.extractQueued(
+		func(e *Event) bool { return e.UserID == userID },
+		func(i *UserIdentifiers) bool { return i.UserID == userID },
+	)
+	c.drop(DropReasonPurged, events, identifiers)
+}
+
+// Ping sends a signed payload without any events or identifier updates to the API, and returns
+// the error of sending it, e.g. to check that the API accepts the credentials of the client.
+// It returns ErrClientClosed if the client is closed.
+func (c *Client) Ping(ctx context.Context) error {
+	if c.closed.Load() {
+		return ErrClientClosed
+	}
+
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer putBuffer(buf)
+
+	m, err := c.marshalPayload(buf, &payload{GameID: c.gameID})
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	return c.send(ctx, m)
+}
+
+// PendingForUser returns copies of the events and identifier updates that are queued for the user,
+// in the order they are sent, e.g. to find out whether an event that didn't show up is still queued.
+// The items stay queued, and changing the copies doesn't change them. The traits are copied
+// shallowly. The items of the queue set via WithQueue aren't included.
+func (c *Client) PendingForUser(userID string) (events []Event, identifiers []UserIdentifiers) {
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+
+	for _, e := range c.eventQueue {
+		if e.UserID != userID {
+			continue
+		}
+		if e.Value != nil {
+			e.Value = PointerFrom(*e.Value)
+		}
+		e.Traits = maps.Clone(e.Traits)
+		e.Metrics = maps.Clone(e.Metrics)
+		events = append(events, e)
+	}
+	for _, u := range c.identifierQueue {
+		if u.UserID != userID {
+			continue
+		}
+		for _, f := range identifierFields {
+			if id := u.Identifiers.field(f); *id != nil {
+				*id = PointerFrom(**id)
+			}
+		}
+		identifiers = append(identifiers, u)
+	}
+	return events, identifiers
+}
+
+// PurgeQueue removes everything that is queued without sending it,
+// and returns the number of events and identifier updates that were removed.
+// The removed items are passed to the drop callback.
+func (c *Client) PurgeQueue() (events int, identifiers int) {
+	c.queueLock.Lock()
+	purgedEvents, purgedIdentifiers := c.eventQueue, c.identifierQueue
+	c.eventQueue, c.identifierQueue = nil, nil
+	c.queueLock.Unlock()
+
+	c.drop(DropReasonPurged, purgedEvents, purgedIdentifiers)
+	return len(purgedEvents), len(purgedIdentifiers)
+}
+
+// drop passes the dropped items to the drop callback, if there is one,
+// and counts them for the self telemetry.
+func (c *Client) drop(reason DropReason, events []Event, identifiers []UserIdentifiers) {
+	if len(events) == 0 && len(identifiers) == 0 {
+		return
+	}
+
+	c.dropped.Add(uint64(len(events) + len(identifiers)))
+	c.countDrop(events, identifiers)
+	if c.onDrop != nil {
+		c.onDrop(reason, events, identifiers)
+	}
+}
+
+// SetFlushInterval changes the time between flushes without the event queue
+// hitting the batch size, e.g. to flush more often under heavy traffic.
+// The next flush of the interval happens d after the change, and 0 disables the interval.
+// It panics if d is negative.
+func (c *Client) SetFlushInterval(d time.Duration) {
+	if d < 0 {
+		panic("flush interval must be at least 0")
+	}
+
+	c.queueLock.Lock()
+	c.flushInterval = d
+	c.queueLock.Unlock()
+
+	// The batch handler reads the latest interval, so a pending signal is enough
+	select {
+	case c.flushIntervalReset <- struct{}{}:
+	default:
+	}
+}
+
+// SetBatchSize changes the batch size, which is the maximum size of the event queue
+// where it will be flushed automatically if reached, and the maximum number of items
+// sent per request. If the queue already holds a full batch of the new size, it is flushed.
+// It panics if batchSize is less than 1, or less than the minimum set via WithMinFlushBatch.
+func (c *Client) SetBatchSize(batchSize int) {
+	if batchSize < 1 {
+		panic("batch size must be at least 1")
+	}
+	if batchSize < c.minFlushBatch {
+		panic("batch size cannot be less than WithMinFlushBatch")
+	}
+
+	c.queueLock.Lock()
+	c.batchSize = batchSize
+	full := c.queueSize() >= batchSize
+	c.queueLock.Unlock()
+
+	if full {
+		c.batchFull()
+	}
+}
+
+// WaitForFlush blocks until the next batch is sent to the API, by any kind of flush,
+// and returns the error of sending it. If ctx is done first, its error is returned.
+// This is useful to synchronize on delivery, e.g. in tests.
+func (c *Client) WaitForFlush(ctx context.Context) error {
+	if c.closed.Load() {
+		return ErrClientClosed
+	}
+
+	ch := make(chan error, 1)
+
+	c.flushWaitersLock.Lock()
+	c.flushWaiters = append(c.flushWaiters, ch)
+	c.flushWaitersLock.Unlock()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		c.flushWaitersLock.Lock()
+		c.flushWaiters = slices.DeleteFunc(c.flushWaiters, func(w chan error) bool {
+			return w == ch
+		})
+		c.flushWaitersLock.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (c *Client) notifyFlushWaiters(err error) {
+	c.flushWaitersLock.Lock()
+	waiters := c.flushWaiters
+	c.flushWaiters = nil
+	c.flushWaitersLock.Unlock()
+
+	// The channels are buffered, so this never blocks
+	for _, ch := range waiters {
+		ch <- err
+	}
+}
+
 // SetIdentifiers submits an identifier to the event queue.
-// This will call Flush no matter what, but whether it will be sent immediately
-// depends on if the cooldown period is active.
+// The identifiers that fail the validators set via WithIdentifierValidator aren't submitted.
+// An empty identifier removes it from the user, with WithStrictIdentifiers only the ones
+// created by RemoveIdentifier do, and the update is rejected if others are empty.
+// This will call Flush unless disabled with WithFlushOnIdentifier,
+// but whether it will be sent immediately depends on if the cooldown period is active.
 // However if the event queue hits the batch size limit,
 // the events will be sent to the API.
 func (c *Client) SetIdentifiers(userID string, is *Identifiers) {
+	if c.closed.Load() {
+		c.reportError(ErrClientClosed)
+		return
+	}
+
 	if is == nil {
 		is = &Identifiers{}
 	}
+	if c.strictIdentifiers {
+		if err := is.checkEmpty(); err != nil {
+			c.reportError(fmt.Errorf("invalid identifiers of user %q: %w", userID, err))
+			return
+		}
+	}
+	if len(c.identifierValidators) > 0 {
+		var errs []error
+		is, errs = is.validate(c.identifierValidators, c.rejectInvalidIdentifiers)
+		for _, err := range errs {
+			c.reportError(fmt.Errorf("invalid identifiers of user %q: %w", userID, err))
+		}
+		if is == nil || *is == (Identifiers{}) && len(errs) > 0 {
+			return
+		}
+	}
 
-	c.appendIdentifier(&identifier{
+	c.appendIdentifier(&UserIdentifiers{
 		Identifiers: *is,
 		UserID:      userID,
 	})
-	if err := c.Flush(); err != nil && c.errorChan != nil {
-		c.errorChan <- err
+	if !c.flushOnIdentifier {
+		return
 	}
+	c.reportError(c.flush(FlushTriggerIdentifier))
 }
 
-// Close closes the open goroutines. It is not concurrency safe.
-func (c *Client) Close() {
-	c.queueLock.Lock()
+// RemoveIdentifiersBatch submits an identifier update for each of the users that removes
+// the fields from them, e.g. to offboard a whole cohort. If no fields are passed,
+// all identifiers are removed. The updates are queued at once, and Flush is called once
+// unless disabled with WithFlushOnIdentifier, just like with SetIdentifiers.
+// It panics if one of the fields is not a known field.
+func (c *Client) RemoveIdentifiersBatch(userIDs []string, fields ...IdentifierField) {
+	if c.closed.Load() {
+		c.reportError(ErrClientClosed)
+		return
+	}
+
+	if len(fields) == 0 {
+		fields = identifierFields
+	}
+	removal := NewIdentifiers().Remove(fields...).Build()
+
+	if len(userIDs) == 0 {
+		return
+	}
+
+	updates := make([]UserIdentifiers, len(userIDs))
+	for i, userID := range userIDs {
+		updates[i] = UserIdentifiers{
+			Identifiers: *removal,
+			UserID:      userID,
+		}
+	}
+	c.appendIdentifiers(updates)
+
+	if !c.flushOnIdentifier {
+		return
+	}
+	c.reportError(c.flush(FlushTriggerIdentifier))
+}
+
+// Start starts the batch handler goroutine of a client that was built with WithDeferredStart,
+// and calls the start callback. Until then, nothing is flushed due to the flush interval, or by
+// the batch handler when the batch size is hit, but the items stay queued.
+// It returns ErrClientStarted if the client was already started, and ErrClientClosed if it is closed.
+func (c *Client) Start() error {
+	c.lifecycleLock.Lock()
+	defer c.lifecycleLock.Unlock()
+
+	if c.closed.Load() {
+		return ErrClientClosed
+	}
+	if c.started {
+		return ErrClientStarted
+	}
+	c.started = true
+
+	go c.handleBatch()
+	if c.metricsInterval > 0 {
+		c.stopMetrics = make(chan struct{})
+		c.metricsDone = make(chan struct{})
+		go c.emitMetrics()
+	}
+
+	if c.onStart != nil {
+		c.onStart()
+	}
+	return nil
+}
+
+// Close closes the open goroutines, and waits for the metrics callback to return
+// if it is running. Calling it more than once does nothing.
+// After Close, the methods that return an error return ErrClientClosed,
+// and the others send it to the error channel instead of queueing anything.
+// The stop callback is only called if the client was started.
+// With WithShutdownTimeout, Close sends what is queued first, and returns the error of that.
+func (c *Client) Close() error {
+	if c.closed.Swap(true) {
+		return nil
+	}
+
+	// Start can't start the client anymore once it is closed
+	c.lifecycleLock.Lock()
+	started := c.started
+	c.lifecycleLock.Unlock()
+
+	c.flushLock.Lock()
 	if c.flushWaiting != nil {
 		c.flushWaiting.Stop()
 	}
+	c.flushLock.Unlock()
+
+	// Without a shutdown timeout, the context is never done
+	ctx := context.Background()
+	var err error
+	if c.shutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(c.backgroundContext(), c.shutdownTimeout)
+		defer cancel()
+		err = c.drainOnClose(ctx)
+	}
+
+	if !started {
+		return err
+	}
+	select {
+	case c.stopBatchHandler <- struct{}{}:
+	case <-ctx.Done():
+		// The batch handler is stuck sending a batch, it stops once it is done
+		go func() { c.stopBatchHandler <- struct{}{} }()
+	}
+	if c.stopMetrics != nil {
+		close(c.stopMetrics)
+		<-c.metricsDone
+	}
+
+	if c.onStop != nil {
+		c.onStop()
+	}
+	return err
+}
+
+func (c *Client) appendEvent(e *Event) {
+	c.appendFilteredEvent(e, c.eventFilter)
+}
+
+// appendFilteredEvent is appendEvent with filter instead of the event filter, nil doesn't filter anything.
+func (c *Client) appendFilteredEvent(e *Event, filter func(e Event) bool) {
+	if c.closed.Load() {
+		c.reportError(ErrClientClosed)
+		return
+	}
+
+	c.setDefaults(e)
+	if filter != nil && !filter(*e) {
+		return
+	}
+	if c.queueEvent(e) {
+		c.batchFull()
+	}
+}
+
+// setDefaults sets the fields of e that have a default and aren't set.
+func (c *Client) setDefaults(e *Event) {
+	if e.Schema == "" {
+		e.Schema = c.defaultSchema
+	}
+}
+
+// queueEvent adds e to the event queue and reports whether the queue holds a full batch.
+func (c *Client) queueEvent(e *Event) bool {
+	return c.queueEvents([]Event{*e})
+}
+
+// queueEvents adds all of events to the event queue at once,
+// and reports whether the queue holds a full batch.
+func (c *Client) queueEvents(events []Event) bool {
+	if c.queue != nil {
+		items := make([]QueueItem, len(events))
+		for i := range events {
+			items[i] = QueueItem{Event: &events[i]}
+		}
+		return c.queueExternally(QueueKindEvent, items...)
+	}
+
+	c.queueLock.Lock()
+	for _, e := range events {
+		// The queue is ordered by priority, then by insertion
+		i := len(c.eventQueue)
+		for i > 0 && c.eventQueue[i-1].priority < e.priority {
+			i--
+		}
+		c.eventQueue = slices.Insert(c.eventQueue, i, e)
+	}
+	depth := len(c.eventQueue)
+	full := c.queueSize() >= c.batchSize
 	c.queueLock.Unlock()
-	c.stopBatchHandler <- struct{}{}
+
+	if c.queueObserver != nil {
+		c.queueObserver(QueueKindEvent, depth)
+	}
+
+	return full
+}
+
+func (c *Client) appendIdentifier(i *UserIdentifiers) {
+	c.appendIdentifiers([]UserIdentifiers{*i})
 }
 
-func (c *Client) appendEvent(e *event) {
+// appendIdentifiers adds all of is to the identifier queue at once.
+func (c *Client) appendIdentifiers(is []UserIdentifiers) {
+	now := time.Now()
+	for i := range is {
+		is[i].queuedAt = now
+	}
+
+	if c.queue != nil {
+		items := make([]QueueItem, len(is))
+		for i := range is {
+			items[i] = QueueItem{Identifiers: &is[i]}
+		}
+		if c.queueExternally(QueueKindIdentifier, items...) {
+			c.batchFull()
+		}
+		return
+	}
+
 	c.queueLock.Lock()
-	c.eventQueue = append(c.eventQueue, *e)
-	queueSize := c.queueSize()
+	for i := range is {
+		if c.coalesceIdentifierRemovals && c.coalesceRemovals(&is[i]) {
+			continue
+		}
+		c.identifierQueue = append(c.identifierQueue, is[i])
+	}
+	depth := len(c.identifierQueue)
+	full := c.queueSize() >= c.batchSize
 	c.queueLock.Unlock()
 
-	if queueSize >= c.batchSize {
-		c.doProcess()
+	if c.queueObserver != nil {
+		c.queueObserver(QueueKindIdentifier, depth)
+	}
+
+	if full {
+		c.batchFull()
+	}
+}
+
+// coalesceRemovals clears the removals of u that are redundant, because the latest queued
+// update of the same field of the user is a removal too. It returns whether u was left without
+// any fields because of that. It must be called with queueLock held.
+func (c *Client) coalesceRemovals(u *UserIdentifiers) bool {
+	left, cleared := 0, 0
+	for _, f := range identifierFields {
+		id := u.Identifiers.field(f)
+		if *id == nil {
+			continue
+		}
+		if **id != "" || !c.removalQueued(u.UserID, f) {
+			left++
+			continue
+		}
+		*id = nil
+		cleared++
+	}
+	return left == 0 && cleared > 0
+}
+
+// removalQueued returns whether the latest queued update of the field of the user is a removal.
+// It must be called with queueLock held.
+func (c *Client) removalQueued(userID string, f IdentifierField) bool {
+	for i := len(c.identifierQueue) - 1; i >= 0; i-- {
+		if c.identifierQueue[i].UserID != userID {
+			continue
+		}
+		if id := *c.identifierQueue[i].Identifiers.field(f); id != nil {
+			return *id == ""
+		}
+	}
+	return false
+}
+
+// batchFull sends a batch once the queue hits the batch size.
+// It is sent by the caller, or by the batch handler goroutine if async batch flushes are enabled.
+func (c *Client) batchFull() {
+	if !c.asyncBatchFlush {
+		c.doProcess(FlushTriggerBatchSize)
+		return
+	}
+
+	c.signalFlush(FlushTriggerBatchSize)
+}
+
+// signalFlush wakes up the batch handler to send a batch.
+func (c *Client) signalFlush(trigger FlushTrigger) {
+	// If a signal is already pending, the handler will send the queued items anyway.
+	select {
+	case c.flushSignal <- trigger:
+	default:
+	}
+}
+
+// extractQueued removes the queued items that match from the queues and returns them.
+// A nil match function doesn't match anything.
+func (c *Client) extractQueued(matchEvent func(e *Event) bool, matchIdentifiers func(i *UserIdentifiers) bool) ([]Event, []UserIdentifiers) {
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+
+	var events []Event
+	if matchEvent != nil {
+		kept := c.eventQueue[:0]
+		for i := range c.eventQueue {
+			if matchEvent(&c.eventQueue[i]) {
+				events = append(events, c.eventQueue[i])
+			} else {
+				kept = append(kept, c.eventQueue[i])
+			}
+		}
+		c.eventQueue = kept
 	}
+
+	var identifiers []UserIdentifiers
+	if matchIdentifiers != nil {
+		kept := c.identifierQueue[:0]
+		for i := range c.identifierQueue {
+			if matchIdentifiers(&c.identifierQueue[i]) {
+				identifiers = append(identifiers, c.identifierQueue[i])
+			} else {
+				kept = append(kept, c.identifierQueue[i])
+			}
+		}
+		c.identifierQueue = kept
+	}
+
+	return events, identifiers
 }
 
-func (c *Client) appendIdentifier(i *identifier) {
+// sendBatches sends the events and identifiers in as many batches as needed.
+// The batches are composed like in process. All batches are attempted,
+// the ones that couldn't be sent are put back in the queue, and the errors of the failed ones are joined.
+// Like processWaiting, it waits for a flush slot first, the items are put back in the queue if ctx is done before.
+func (c *Client) sendBatches(ctx context.Context, events []Event, identifiers []UserIdentifiers) error {
+	ctx, cancel := c.flushContext(ctx)
+	defer cancel()
+
+	if err := c.acquireFlushSlot(ctx); err != nil {
+		c.requeue([]*payload{{Events: events, Identifiers: identifiers}})
+		return err
+	}
+	defer c.releaseFlushSlot()
+
 	c.queueLock.Lock()
-	c.identifierQueue = append(c.identifierQueue, *i)
-	queueSize := c.queueSize()
+	batchSize := c.batchSize
 	c.queueLock.Unlock()
 
-	if queueSize >= c.batchSize {
-		c.doProcess()
+	var errs []error
+	var unsent []*payload
+	for len(events) > 0 || len(identifiers) > 0 {
+		i, j := c.batchComposition.split(len(identifiers), len(events), batchSize)
+
+		p, err := c.sendBatch(ctx, events[:j], identifiers[:i])
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if p != nil {
+			unsent = append(unsent, p)
+		}
+
+		events, identifiers = events[j:], identifiers[i:]
 	}
+	c.requeue(unsent)
+	return errors.Join(errs...)
+}
+
+// eventTime returns the time of an event that is tracked now.
+func (c *Client) eventTime() string {
+	return c.timeFunc().Format(time.RFC3339)
+}
+
+func (c *Client) eventName(name string) string {
+	if c.eventNameTransform != nil {
+		return c.eventNameTransform(name)
+	}
+	return name
 }
 
 func (c *Client) queueSize() int {
-	return len(c.eventQueue) + len(c.identifierQueue)
+	size := len(c.eventQueue) + len(c.identifierQueue)
+	if c.queue != nil {
+		size += c.queue.Len()
+	}
+	return size
 }
 
 func (c *Client) sign(msg []byte, timestamp string) (string, error) {
-	h := hmac.New(sha256.New, []byte(c.clientSecret))
+	if c.signer != nil {
+		return c.signer(c.clientID, c.clientSecret, timestamp, msg)
+	}
+
+	sum, err := hmacSum(c.clientID, c.clientSecret, timestamp, msg)
+	if err != nil {
+		return "", err
+	}
+
+	if c.signatureEncoding == SignatureEncodingBase64 {
+		return base64.StdEncoding.EncodeToString(sum), nil
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// DebugSignedString returns the exact string that the default signer signs for a request
+// with the given timestamp and body, which is the client ID followed by the timestamp and the body.
+// Comparing it with what the API expects helps to find out why a signature doesn't match.
+// The timestamp and body of a request can be inspected with WithHTTPTap.
+// It doesn't know what a custom signer set via WithSigner signs.
+func (c *Client) DebugSignedString(timestamp string, body []byte) string {
+	return signedString(c.clientID, timestamp, body)
+}
+
+// signedString returns the string that is signed by hmacSum.
+func signedString(clientID, timestamp string, body []byte) string {
+	return fmt.Sprintf("%s%s%s", clientID, timestamp, body)
+}
+
+// hmacSum returns the HMAC-SHA256 of clientID + timestamp + body keyed with clientSecret.
+func hmacSum(clientID, clientSecret, timestamp string, body []byte) ([]byte, error) {
+	h := hmac.New(sha256.New, []byte(clientSecret))
 
-	body := fmt.Sprintf("%s%s%s", c.clientID, timestamp, msg)
+	msg := signedString(clientID, timestamp, body)
 
-	if _, err := h.Write([]byte(body)); err != nil {
-		return "", fmt.Errorf("failed to write hmac body: %w", err)
+	if _, err := h.Write([]byte(msg)); err != nil {
+		return nil, fmt.Errorf("failed to write hmac body: %w", err)
 	}
 
-	return hex.EncodeToString(h.Sum(nil)), nil
+	return h.Sum(nil), nil
 }
 
 func (c *Client) handleBatch() {
-	ticker := time.NewTicker(c.flushInterval)
-	defer ticker.Stop()
+	var ticker *time.Ticker
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+
+	// A zero interval disables the ticker, which leaves a nil channel that never fires
+	resetTicker := func() <-chan time.Time {
+		c.queueLock.Lock()
+		interval := c.flushInterval
+		c.queueLock.Unlock()
+
+		if ticker != nil {
+			ticker.Stop()
+			ticker = nil
+		}
+		if interval == 0 {
+			return nil
+		}
+		ticker = time.NewTicker(interval)
+		return ticker.C
+	}
+	tick := resetTicker()
 
 	for {
 		select {
 		case <-c.stopBatchHandler:
 			return
-		case <-ticker.C:
-			if err := c.Flush(); err != nil && c.errorChan != nil {
-				c.errorChan <- err
-			}
+		case <-tick:
+			c.reportError(c.flush(FlushTriggerInterval))
+		case trigger := <-c.flushSignal:
+			c.doProcess(trigger)
+		case <-c.flushIntervalReset:
+			tick = resetTicker()
 		}
 	}
 }
 
-func (c *Client) doProcess() {
-	if err := c.process(); err != nil && c.errorChan != nil {
-		c.errorChan <- err
+// reportError sends err to the error channel, if there is an error and a channel.
+// If the channel was closed, err is dropped.
+func (c *Client) reportError(err error) {
+	if err == nil || c.errorChan == nil {
+		return
 	}
+
+	// Sending on a closed channel panics, which shouldn't crash the goroutine that flushed
+	defer func() {
+		_ = recover()
+	}()
+	c.errorChan <- err
 }
 
-func (c *Client) process() error {
+// backgroundContext returns the context of the flushes that aren't passed one.
+func (c *Client) backgroundContext() context.Context {
+	if c.baseContext != nil {
+		return c.baseContext()
+	}
+	return context.Background()
+}
+
+// flushContext returns ctx bounded by the flush deadline, if there is one.
+func (c *Client) flushContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.flushDeadline == 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.flushDeadline)
+}
+
+func (c *Client) doProcess(trigger FlushTrigger) {
+	c.reportError(c.process(c.backgroundContext(), trigger))
+}
+
+// process sends the queued items, and passes trigger and the result to the flush callback.
+func (c *Client) process(ctx context.Context, trigger FlushTrigger) error {
+	_, err := c.processWithOutcome(ctx, trigger)
+	return err
+}
+
+// processWithOutcome is process, but it also returns FlushOutcomeScheduled instead of
+// FlushOutcomeSent if the flush was coalesced with the flushes in flight.
+func (c *Client) processWithOutcome(ctx context.Context, trigger FlushTrigger) (FlushOutcome, error) {
+	if c.flushSlots != nil {
+		select {
+		case c.flushSlots <- struct{}{}:
+			defer c.releaseFlushSlot()
+		default:
+			// Coalesce with the flushes in flight, another batch
+			// is sent once one of them is done.
+			c.pendingTrigger.Store(int32(trigger))
+			c.flushPending.Store(true)
+			return FlushOutcomeScheduled, nil
+		}
+	}
+
+	ctx, cancel := c.flushContext(ctx)
+	defer cancel()
+	return FlushOutcomeSent, c.sendQueued(ctx, trigger)
+}
+
+// processWaiting is process for the callers that want the error of sending the items,
+// so instead of coalescing with the flushes in flight, it waits for one of them to be done.
+// If ctx is done first, its error is returned.
+func (c *Client) processWaiting(ctx context.Context, trigger FlushTrigger) error {
+	ctx, cancel := c.flushContext(ctx)
+	defer cancel()
+
+	if err := c.acquireFlushSlot(ctx); err != nil {
+		return err
+	}
+	defer c.releaseFlushSlot()
+	return c.sendQueued(ctx, trigger)
+}
+
+// sendQueued drains the queue, and passes trigger and the result to the flush callback.
+func (c *Client) sendQueued(ctx context.Context, trigger FlushTrigger) error {
+	err := c.drain(ctx, c.maxBatchesPerFlush, nil)
+	if c.onFlush != nil {
+		c.onFlush(trigger, err)
+	}
+	return err
+}
+
+// drain sends the queue as it is now in batches, up to maxBatches of them unless it is 0.
+// Items that are queued while the batches are sent only go out if they fit into the last batch.
+// The result of each batch is passed to report, unless it is nil.
+func (c *Client) drain(ctx context.Context, maxBatches int, report func(FlushResult)) error {
+	c.dropExpiredIdentifiers()
+	c.queueTelemetry()
+
 	c.queueLock.Lock()
+	batches := (c.queueSize() + c.batchSize - 1) / c.batchSize
+	c.queueLock.Unlock()
+	if maxBatches > 0 {
+		batches = min(batches, maxBatches)
+	}
+
+	var errs []error
+	var unsent []*payload
+	for ; batches > 0; batches-- {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, err)
+			break
+		}
+
+		events, identifiers, takeErr := c.takeBatch()
+		if takeErr != nil {
+			errs = append(errs, takeErr)
+		}
+		if len(events) == 0 && len(identifiers) == 0 {
+			break
+		}
+
+		start := time.Now()
+		p, err := c.sendBatch(ctx, events, identifiers)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if p != nil {
+			unsent = append(unsent, p)
+		}
+		if report != nil {
+			report(FlushResult{
+				Events:      len(events),
+				Identifiers: len(identifiers),
+				Err:         err,
+				Latency:     time.Since(start),
+			})
+		}
+		if takeErr != nil {
+			break
+		}
+	}
+	c.requeue(unsent)
 
-	events := make([]event, 0, c.batchSize)
-	identifiers := make([]identifier, 0, c.batchSize)
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return errors.Join(errs...)
+}
 
-	i := 0
-	for ; i < c.batchSize && i < len(c.identifierQueue); i++ {
-		identifiers = append(identifiers, c.identifierQueue[i])
+// dropExpiredIdentifiers removes the identifier updates that are older than the
+// maximum age from the queue, and passes them to the drop callback.
+func (c *Client) dropExpiredIdentifiers() {
+	if c.identifierMaxAge == 0 {
+		return
 	}
+
+	cutoff := time.Now().Add(-c.identifierMaxAge)
+	_, expired := c.extractQueued(nil, func(i *UserIdentifiers) bool {
+		return i.queuedAt.Before(cutoff)
+	})
+	c.drop(DropReasonExpired, nil, expired)
+}
+
+// takeBatch removes the items of the next batch from the queue and returns them.
+// The items in memory, e.g. the ones that couldn't be sent, are taken before
+// the ones of the queue set via WithQueue, which fill the space that is left.
+// If the queue fails, the items in memory are returned along with the error.
+func (c *Client) takeBatch() ([]Event, []UserIdentifiers, error) {
+	events, identifiers, left := c.takeQueued()
+	if c.queue == nil || left == 0 {
+		return events, identifiers, nil
+	}
+
+	moreEvents, moreIdentifiers, err := c.dequeueBatch(left)
+	return append(events, moreEvents...), append(identifiers, moreIdentifiers...), err
+}
+
+// takeQueued removes the items of the next batch from the in-memory queue and returns them,
+// along with the space that is left in the batch.
+func (c *Client) takeQueued() ([]Event, []UserIdentifiers, int) {
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+
+	i, j := c.batchComposition.split(len(c.identifierQueue), len(c.eventQueue), c.batchSize)
+	identifiers := append(make([]UserIdentifiers, 0, i), c.identifierQueue[:i]...)
+	events := append(make([]Event, 0, j), c.eventQueue[:j]...)
+
 	if i < len(c.identifierQueue) {
 		c.identifierQueue = c.identifierQueue[i:]
 	} else {
 		c.identifierQueue = c.identifierQueue[:0]
 	}
-
-	j := 0
-	for ; i < c.batchSize && j < len(c.eventQueue); j++ {
-		events = append(events, c.eventQueue[j])
-		i++
-	}
 	if j < len(c.eventQueue) {
 		c.eventQueue = c.eventQueue[j:]
 	} else {
 		c.eventQueue = c.eventQueue[:0]
 	}
 
+	return events, identifiers, c.batchSize - i - j
+}
+
+// requeue puts the items of the payloads that couldn't be sent back in front of
+// the queue, in their original order, so they are sent with the next flush.
+func (c *Client) requeue(unsent []*payload) {
+	if len(unsent) == 0 {
+		return
+	}
+
+	var events []Event
+	var identifiers []UserIdentifiers
+	for _, p := range unsent {
+		events = append(events, p.Events...)
+		identifiers = append(identifiers, p.Identifiers...)
+	}
+
+	c.queueLock.Lock()
+	c.eventQueue = append(events, c.eventQueue...)
+	c.identifierQueue = append(identifiers, c.identifierQueue...)
 	c.queueLock.Unlock()
+}
+
+// split returns the number of identifier updates and events that go into
+// a batch of size, out of the queued ones.
+func (bc BatchComposition) split(identifiers, events, size int) (i int, j int) {
+	switch bc {
+	case BatchCompositionEventsFirst:
+		j = min(events, size)
+		i = min(identifiers, size-j)
+	case BatchCompositionInterleaved:
+		i = min(identifiers, (size+1)/2)
+		j = min(events, size-i)
+		i = min(identifiers, size-j)
+	default:
+		i = min(identifiers, size)
+		j = min(events, size-i)
+	}
+	return i, j
+}
 
+// sendBatch marshals the events and identifiers into a payload and sends it.
+// The result is passed to the callers of WaitForFlush.
+// If the payload couldn't be sent, it is returned along with the error.
+func (c *Client) sendBatch(ctx context.Context, events []Event, identifiers []UserIdentifiers) (*payload, error) {
 	// Skip processing if queue empty
 	if len(events) == 0 && len(identifiers) == 0 {
-		return nil
+		return nil, nil
 	}
 
-	payload := map[string]any{
-		"gameId":      c.gameID,
-		"events":      events,
-		"identifiers": identifiers,
+	unsent, err := c.deliverBatch(ctx, events, identifiers)
+	c.notifyFlushWaiters(err)
+	return unsent, err
+}
+
+// deliverBatch is sendBatch without notifying the callers of WaitForFlush.
+// The payload is only returned if sending it failed and it wasn't spooled,
+// events that were dropped because they can't be marshalled aren't part of it.
+func (c *Client) deliverBatch(ctx context.Context, events []Event, identifiers []UserIdentifiers) (*payload, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer putBuffer(buf)
+
+	p := &payload{
+		GameID:      c.gameID,
+		Events:      events,
+		Identifiers: identifiers,
+	}
+	m, err := c.marshalPayload(buf, p)
+	if err == nil {
+		return c.sendPayload(ctx, p, m)
 	}
 
-	m, err := json.Marshal(&payload)
+	// A single event with traits that can't be marshalled shouldn't take
+	// the rest of the batch down with it, so drop the offending events and
+	// try again without them. If the events can be marshalled on their own,
+	// or the payload can't be marshalled without them either, the problem
+	// isn't with the events.
+	var dropped []Event
+	var errs []error
+	p.Events, dropped, errs = c.dropUnmarshalable(events)
+	if len(dropped) == 0 {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	m, err = c.marshalPayload(buf, p)
 	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %w", err)
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
 	}
 
-	return c.send(m)
+	c.drop(DropReasonUnmarshalable, dropped, nil)
+	if c.onDrop != nil {
+		// The drop callback replaces the errors of the dropped events
+		errs = nil
+	}
+	// The identifier updates of the batch are still sent, unless there are none
+	if len(p.Events) == 0 && len(p.Identifiers) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	unsent, err := c.sendPayload(ctx, p, m)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return unsent, errors.Join(errs...)
 }
 
-func (c *Client) send(msg []byte) error {
-	timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+// sendPayload sends m, the marshalled p, and returns p if that fails and it wasn't spooled.
+func (c *Client) sendPayload(ctx context.Context, p *payload, m []byte) (*payload, error) {
+	if c.payloadSizeWarning > 0 && len(m) > c.payloadSizeWarning {
+		c.onPayloadSizeWarning(len(m))
+	}
 
-	signature, err := c.sign(msg, timestamp)
+	spooled, err := c.sendOrSpool(ctx, m)
 	if err != nil {
-		return fmt.Errorf("failed to sign message: %w", err)
+		c.sendFailures.Add(1)
+		c.countSendFailure(err)
+	}
+	if err == nil || spooled {
+		return nil, err
 	}
+	return p, err
+}
 
-	req, err := http.NewRequest("POST", c.dsn, bytes.NewReader(msg))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+// dropUnmarshalable returns the events that can be marshalled on their own,
+// and the ones that can't along with an error for each of them.
+func (c *Client) dropUnmarshalable(events []Event) (valid, dropped []Event, errs []error) {
+	valid = make([]Event, 0, len(events))
+	for _, e := range events {
+		if _, err := c.marshalValue(&e); err != nil {
+			dropped = append(dropped, e)
+			errs = append(errs, fmt.Errorf("dropped event %q for user %q: %w", e.Event, e.UserID, err))
+			continue
+		}
+		valid = append(valid, e)
 	}
+	return valid, dropped, errs
+}
 
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-client-id", c.clientID)
-	req.Header.Set("x-timestamp", timestamp)
-	req.Header.Set("x-signature", signature)
+// marshalValue marshals v with the custom marshaler if there is one,
+// otherwise with json.Marshal.
+func (c *Client) marshalValue(v any) ([]byte, error) {
+	if c.marshaler != nil {
+		return c.marshaler(v)
+	}
+	return json.Marshal(v)
+}
 
-	res, err := c.httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to do request: %w", err)
+// marshalPayload marshals p with the custom marshaler if there is one,
+// otherwise it is encoded into buf, as NDJSON if that is the payload encoding. The values of the events are formatted
+// with the value formatter, if there is one.
+func (c *Client) marshalPayload(buf *bytes.Buffer, p *payload) ([]byte, error) {
+	if c.payloadEncoding == PayloadEncodingNDJSON {
+		return c.marshalNDJSON(buf, p)
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode >= 500 {
-		return fmt.Errorf("server returned server error: %d", res.StatusCode)
+	// Nil slices would be marshalled as null instead of empty arrays
+	if p.Events == nil {
+		p.Events = []Event{}
+	}
+	if p.Identifiers == nil {
+		p.Identifiers = []UserIdentifiers{}
 	}
 
-	var m map[string]any
-	if err := json.NewDecoder(res.Body).Decode(&m); err != nil {
-		return fmt.Errorf("failed to decode response body: %w", err)
+	var v any = p
+	var events any = p.Events
+	if c.valueFormatter != nil {
+		fp := c.formatValues(p)
+		v, events = fp, fp.Events
 	}
 
-	if b, ok := m["message"]; ok {
-		if s, ok := b.(string); ok {
-			if s == "OK" {
-				return nil
-			}
+	if c.omitEmptyArrays {
+		sp := &sparsePayload{GameID: p.GameID, Identifiers: p.Identifiers}
+		if len(p.Events) > 0 {
+			sp.Events = events
 		}
+		v = sp
+	}
+
+	if c.marshaler != nil {
+		return c.marshaler(v)
 	}
+	return encodePayload(buf, v)
+}
 
-	if b, ok := m["error"]; ok {
-		if s, ok := b.(string); ok {
-			return fmt.Errorf("server returned error: %s", s)
+// formatValues returns a copy of p with the values of its events formatted by the value formatter.
+func (c *Client) formatValues(p *payload) *formattedPayload {
+	events := make([]formattedEvent, len(p.Events))
+	for i := range p.Events {
+		events[i] = formattedEvent{
+			Event: p.Events[i],
+			Value: c.valueFormatter(p.Events[i].Value),
 		}
 	}
 
-	return fmt.Errorf("unexpected response from server: %v", m)
+	return &formattedPayload{
+		GameID:      p.GameID,
+		Events:      events,
+		Identifiers: p.Identifiers,
+	}
+}
+
+// encodePayload encodes p into buf and returns the encoded bytes,
+// which are only valid until buf is reused.
+func encodePayload(buf *bytes.Buffer, p any) ([]byte, error) {
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(p); err != nil {
+		return nil, err
+	}
+
+	// Encode terminates the value with a newline, which isn't part of the payload.
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	// Don't hold on to unusually large buffers.
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// acquireFlushSlot waits for one of the flushes in flight to be done if the maximum number of them
+// set via WithMaxInFlightFlushes is reached. If ctx is done first, its error is returned,
+// otherwise the slot has to be released via releaseFlushSlot.
+func (c *Client) acquireFlushSlot(ctx context.Context) error {
+	if c.flushSlots == nil {
+		return nil
+	}
+
+	select {
+	case c.flushSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) releaseFlushSlot() {
+	if c.flushSlots == nil {
+		return
+	}
+	<-c.flushSlots
+	if c.flushPending.Swap(false) {
+		c.signalFlush(FlushTrigger(c.pendingTrigger.Load()))
+	}
+}
+
+func (c *Client) send(ctx context.Context, msg []byte) error {
+	timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	signature, err := c.sign(msg, timestamp)
+	if err != nil {
+		return fmt.Errorf("failed to sign message: %w", err)
+	}
+
+	headers := map[string]string{
+		c.clientIDHeader:  c.clientID,
+		c.timestampHeader: timestamp,
+		c.signatureHeader: signature,
+		"x-sdk-version":   sdkVersion,
+		// The retries of the transport reuse the headers, so the API can drop
+		// a batch whose first attempt succeeded even though it seemed to fail
+		"x-idempotency-key": uuid.NewString(),
+	}
+	if c.name != "" {
+		headers["x-client-name"] = c.name
+	}
+	if c.payloadEncoding == PayloadEncodingNDJSON {
+		headers["Content-Type"] = ndjsonContentType
+	}
+
+	begin := time.Now()
+	err = c.transport.Send(ctx, msg, headers)
+	c.latency.record(time.Since(begin))
+	c.bytesSent.Add(uint64(len(msg)))
+	return err
 }
 
 func PointerFrom[T any](v T) *T {
 	return &v
 }
 
-func combineTraits(a, b Traits) Traits {
-	n := make(Traits, len(a)+len(b))
-	for k := range a {
-		n[k] = a[k]
+// eventTraits combines the trait layers of an event in order of precedence:
+// the traits of the call overwrite the round's traits, which overwrite the global traits.
+func (c *Client) eventTraits(round, call Traits) Traits {
+	if c.trimTraitStrings {
+		return trimTraitStrings(combineTraits(c.globalTraits, round, call))
+	}
+	// Keep the traits of events without rounds as they are if there's nothing to combine
+	if round == nil && len(c.globalTraits) == 0 {
+		return call
 	}
-	for k := range b {
-		n[k] = b[k]
+	return combineTraits(c.globalTraits, round, call)
+}
+
+// trimTraitStrings trims the leading and trailing whitespace of the string values of traits in place.
+func trimTraitStrings(traits Traits) Traits {
+	for k, v := range traits {
+		if s, ok := v.(string); ok {
+			traits[k] = strings.TrimSpace(s)
+		}
+	}
+	return traits
+}
+
+// combineTraits combines the traits into a new map, later traits overwrite earlier ones.
+func combineTraits(traits ...Traits) Traits {
+	size := 0
+	for _, t := range traits {
+		size += len(t)
+	}
+
+	n := make(Traits, size)
+	for _, t := range traits {
+		for k := range t {
+			n[k] = t[k]
+		}
 	}
 	return n
 }
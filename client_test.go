@@ -1,14 +1,25 @@
 package earnalliance
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -25,7 +36,7 @@ func TestFlush(t *testing.T) {
 			Build()
 		defer client.Close()
 
-		client.httpClient = nil
+		client.transport = nil
 
 		err := client.Flush()
 		require.Nil(t, err)
@@ -45,7 +56,7 @@ func TestFlush(t *testing.T) {
 
 		requestCounter := 0
 
-		client.httpClient = &mockHttpClient{
+		client.transport.(*httpTransport).client = &mockHttpClient{
 			handle: func(req *http.Request) (*http.Response, error) {
 				defer wg.Done()
 
@@ -107,7 +118,7 @@ func TestFlush(t *testing.T) {
 
 		requestCounter := 0
 
-		client.httpClient = &mockHttpClient{
+		client.transport.(*httpTransport).client = &mockHttpClient{
 			handle: func(req *http.Request) (*http.Response, error) {
 				defer wg.Done()
 
@@ -174,7 +185,7 @@ func TestFlush(t *testing.T) {
 
 		requestCounter := 0
 
-		client.httpClient = &mockHttpClient{
+		client.transport.(*httpTransport).client = &mockHttpClient{
 			handle: func(req *http.Request) (*http.Response, error) {
 				defer wg.Done()
 
@@ -217,7 +228,7 @@ func TestFlush(t *testing.T) {
 
 		requestCounter := 0
 
-		client.httpClient = &mockHttpClient{
+		client.transport.(*httpTransport).client = &mockHttpClient{
 			handle: func(req *http.Request) (*http.Response, error) {
 				defer wg.Done()
 
@@ -275,7 +286,7 @@ func TestTrack(t *testing.T) {
 			Build()
 		defer client.Close()
 
-		client.httpClient = nil
+		client.transport = nil
 
 		client.Track("asd", "kill", PointerFrom(1), nil)
 
@@ -294,17 +305,37 @@ func TestTrack(t *testing.T) {
 			Build()
 		defer client.Close()
 
-		client.httpClient = nil
+		client.transport = nil
 
 		client.StartGame("asd")
 
 		e := &client.eventQueue[0]
 		require.Equal(t, e.UserID, "asd")
-		require.Equal(t, e.Event, startGameEvent)
+		require.Equal(t, e.Event, StartGameEvent)
 		require.Nil(t, e.Value)
 		require.Nil(t, e.Traits)
 	})
 
+	t.Run("start game with custom name", func(t *testing.T) {
+		client := NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithFlushCooldown(5 * time.Second).
+			WithStartGameEventName("SESSION_START").
+			WithEventNameTransform(strings.ToLower).
+			Build()
+		defer client.Close()
+
+		client.transport = nil
+
+		client.StartGame("asd")
+
+		// The transform isn't applied to the reserved name
+		e := &client.eventQueue[0]
+		require.Equal(t, "SESSION_START", e.Event)
+	})
+
 	t.Run("multiple tracks", func(t *testing.T) {
 		client := NewClientBuilder().
 			WithClientID("a").
@@ -314,7 +345,7 @@ func TestTrack(t *testing.T) {
 			Build()
 		defer client.Close()
 
-		client.httpClient = nil
+		client.transport = nil
 
 		client.Track("asd", "kill", PointerFrom(1), nil)
 		client.Track("asd2", "kill2", PointerFrom(2), nil)
@@ -355,7 +386,7 @@ func TestTrack(t *testing.T) {
 
 		requestCounter := 0
 
-		client.httpClient = &mockHttpClient{
+		client.transport.(*httpTransport).client = &mockHttpClient{
 			handle: func(req *http.Request) (*http.Response, error) {
 				defer wg.Done()
 
@@ -386,6 +417,410 @@ func TestTrack(t *testing.T) {
 	})
 }
 
+func TestTrackError(t *testing.T) {
+	t.Run("default name", func(t *testing.T) {
+		client := NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithFlushCooldown(5 * time.Second).
+			Build()
+		defer client.Close()
+
+		client.transport = nil
+
+		client.TrackError("asd", nil, nil)
+		require.Empty(t, client.eventQueue)
+
+		client.TrackError("asd", fmt.Errorf("boom"), Traits{"message": "overwritten", "level": 3})
+
+		e := &client.eventQueue[0]
+		require.Equal(t, "asd", e.UserID)
+		require.Equal(t, "ERROR", e.Event)
+		require.Equal(t, Traits{"message": "boom", "level": 3}, e.Traits)
+	})
+
+	t.Run("custom name with stack trace", func(t *testing.T) {
+		client := NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithFlushCooldown(5 * time.Second).
+			WithErrorEventName("EXCEPTION").
+			WithErrorStackTrace(true).
+			Build()
+		defer client.Close()
+
+		client.transport = nil
+
+		client.TrackError("asd", fmt.Errorf("boom"), nil)
+
+		e := &client.eventQueue[0]
+		require.Equal(t, "EXCEPTION", e.Event)
+		require.Equal(t, "boom", e.Traits["message"])
+		require.Contains(t, e.Traits["stack"], "TestTrackError")
+	})
+}
+
+func TestTrackPriority(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithBatchSize(10).
+		Build()
+	defer client.Close()
+
+	var sent []string
+	client.transport.(*httpTransport).client = &mockHttpClient{
+		handle: func(req *http.Request) (*http.Response, error) {
+			b, err := io.ReadAll(req.Body)
+			require.Nil(t, err)
+			sent = append(sent, string(b))
+
+			return &http.Response{
+				Body: io.NopCloser(strings.NewReader(`{"message":"OK"}`)),
+			}, nil
+		},
+	}
+
+	client.queueLock.Lock()
+	client.eventQueue = []Event{{Event: "telemetry-1"}, {Event: "telemetry-2"}, {Event: "telemetry-3"}}
+	client.queueLock.Unlock()
+
+	client.TrackPriority("asd", "purchase-1", nil, nil, PriorityHigh)
+	client.TrackPriority("asd", "purchase-2", nil, nil, PriorityHigh)
+	client.TrackPriority("asd", "telemetry-4", nil, nil, PriorityNormal)
+
+	client.queueLock.Lock()
+	var names []string
+	for _, e := range client.eventQueue {
+		names = append(names, e.Event)
+	}
+	client.queueLock.Unlock()
+	require.Equal(t, []string{"purchase-1", "purchase-2", "telemetry-1", "telemetry-2", "telemetry-3", "telemetry-4"}, names)
+
+	// Only the high priority events fit into the next batch
+	client.batchSize = 2
+	require.Nil(t, client.process(context.Background(), FlushTriggerExplicit))
+	require.Contains(t, sent[0], `"event":"purchase-1"`)
+	require.Contains(t, sent[0], `"event":"purchase-2"`)
+	require.NotContains(t, sent[0], `telemetry`)
+}
+
+func TestEventNameTransform(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithEventNameTransform(strings.ToUpper).
+		Build()
+	defer client.Close()
+
+	client.transport = nil
+
+	client.Track("asd", "kill", nil, nil)
+	client.StartRound("", nil).Track("asd", "Death", nil, nil)
+	client.StartGame("asd")
+
+	require.Equal(t, "KILL", client.eventQueue[0].Event)
+	require.Equal(t, "DEATH", client.eventQueue[1].Event)
+	require.Equal(t, StartGameEvent, client.eventQueue[2].Event)
+}
+
+func TestAsyncBatchFlush(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithBatchSize(2).
+		WithAsyncBatchFlush(true).
+		Build()
+	defer client.Close()
+
+	release := make(chan struct{})
+	sent := make(chan string, 1)
+
+	client.transport.(*httpTransport).client = &mockHttpClient{
+		handle: func(req *http.Request) (*http.Response, error) {
+			<-release
+
+			b, err := io.ReadAll(req.Body)
+			require.Nil(t, err)
+			sent <- string(b)
+
+			return &http.Response{
+				Body: io.NopCloser(strings.NewReader(`{"message":"OK"}`)),
+			}, nil
+		},
+	}
+
+	client.Track("asd", "kill", nil, nil)
+	// Fills the batch, but returns while the request is still blocked
+	client.Track("asd", "death", nil, nil)
+
+	close(release)
+
+	b := <-sent
+	require.Contains(t, b, `"event":"kill"`)
+	require.Contains(t, b, `"event":"death"`)
+}
+
+func TestAsyncBatchFlushDefault(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithBatchSize(2).
+		Build()
+	defer client.Close()
+
+	release := make(chan struct{})
+	sent := make(chan string, 1)
+
+	client.transport.(*httpTransport).client = &mockHttpClient{
+		handle: func(req *http.Request) (*http.Response, error) {
+			<-release
+
+			b, err := io.ReadAll(req.Body)
+			require.Nil(t, err)
+			sent <- string(b)
+
+			return &http.Response{
+				Body: io.NopCloser(strings.NewReader(`{"message":"OK"}`)),
+			}, nil
+		},
+	}
+
+	tracked := make(chan struct{})
+	go func() {
+		client.Track("asd", "kill", nil, nil)
+		// Fills the batch, which is sent by the batch handler instead of the caller
+		client.Track("asd", "death", nil, nil)
+		close(tracked)
+	}()
+
+	select {
+	case <-tracked:
+	case <-time.After(time.Second):
+		t.Fatal("Track blocked on sending the full batch")
+	}
+
+	close(release)
+
+	b := <-sent
+	require.Contains(t, b, `"event":"kill"`)
+	require.Contains(t, b, `"event":"death"`)
+}
+
+func TestMaxInFlightFlushes(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithBatchSize(1).
+		WithMaxInFlightFlushes(1).
+		Build()
+	defer client.Close()
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	sent := make(chan string, 10)
+	var inFlight, maxInFlight atomic.Int32
+
+	client.transport.(*httpTransport).client = &mockHttpClient{
+		handle: func(req *http.Request) (*http.Response, error) {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			if n > maxInFlight.Load() {
+				maxInFlight.Store(n)
+			}
+
+			started <- struct{}{}
+			<-release
+
+			b, err := io.ReadAll(req.Body)
+			require.Nil(t, err)
+			sent <- string(b)
+
+			return &http.Response{
+				Body: io.NopCloser(strings.NewReader(`{"message":"OK"}`)),
+			}, nil
+		},
+	}
+
+	client.Track("asd", "first", nil, nil)
+	<-started
+
+	client.Track("asd", "second", nil, nil)
+	// The limit is reached, so this returns immediately without sending
+	require.Nil(t, client.Flush())
+
+	close(release)
+
+	require.Contains(t, <-sent, `"event":"first"`)
+	require.Contains(t, <-sent, `"event":"second"`)
+	require.Equal(t, int32(1), maxInFlight.Load())
+}
+
+func TestMaxInFlightFlushesWait(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithBatchSize(1).
+		WithMaxInFlightFlushes(1).
+		Build()
+	defer client.Close()
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	sent := make(chan string, 10)
+
+	client.transport.(*httpTransport).client = &mockHttpClient{
+		handle: func(req *http.Request) (*http.Response, error) {
+			started <- struct{}{}
+			<-release
+
+			b, err := io.ReadAll(req.Body)
+			require.Nil(t, err)
+			sent <- string(b)
+
+			return &http.Response{
+				Body: io.NopCloser(strings.NewReader(`{"message":"OK"}`)),
+			}, nil
+		},
+	}
+
+	client.Track("asd", "first", nil, nil)
+	<-started
+
+	client.Track("asd", "second", nil, nil)
+	// The flush is coalesced with the one in flight
+	outcome, err := client.FlushWithOutcome()
+	require.Nil(t, err)
+	require.Equal(t, FlushOutcomeScheduled, outcome)
+
+	// The flushes that return the error of sending wait for the flush in flight
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.True(t, errors.Is(client.ForceFlush(ctx), context.DeadlineExceeded))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.ForceFlush(context.Background())
+	}()
+	select {
+	case <-done:
+		t.Fatal("ForceFlush returned while the limit was reached")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+
+	require.Nil(t, <-done)
+	require.Contains(t, <-sent, `"event":"first"`)
+	require.Contains(t, <-sent, `"event":"second"`)
+}
+
+func TestFlushUserMaxInFlight(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithMaxInFlightFlushes(1).
+		Build()
+	defer client.Close()
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 10)
+	sent := make(chan string, 10)
+
+	client.transport.(*httpTransport).client = &mockHttpClient{
+		handle: func(req *http.Request) (*http.Response, error) {
+			started <- struct{}{}
+			<-release
+
+			b, err := io.ReadAll(req.Body)
+			require.Nil(t, err)
+			sent <- string(b)
+
+			return &http.Response{
+				Body: io.NopCloser(strings.NewReader(`{"message":"OK"}`)),
+			}, nil
+		},
+	}
+
+	client.Track("other", "first", nil, nil)
+	go client.Flush()
+	<-started
+
+	client.Track("vip", "kill", nil, nil)
+
+	// FlushUser waits for the flush in flight, and keeps the items queued if ctx is done first
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.True(t, errors.Is(client.FlushUser(ctx, "vip"), context.DeadlineExceeded))
+	events, _ := client.PendingForUser("vip")
+	require.Len(t, events, 1)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.FlushUser(context.Background(), "vip")
+	}()
+	select {
+	case <-done:
+		t.Fatal("FlushUser returned while the limit was reached")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+
+	require.Nil(t, <-done)
+	require.Contains(t, <-sent, `"event":"first"`)
+	require.Contains(t, <-sent, `"event":"kill"`)
+}
+
+func TestQueueObserver(t *testing.T) {
+	type observation struct {
+		kind  QueueKind
+		depth int
+	}
+	var observations []observation
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithQueueObserver(func(kind QueueKind, depth int) {
+			observations = append(observations, observation{kind, depth})
+		}).
+		Build()
+	defer client.Close()
+
+	client.transport = nil
+
+	client.Track("asd", "kill", nil, nil)
+	client.StartGame("asd")
+	client.appendIdentifier(&UserIdentifiers{UserID: "asd"})
+	client.StartRound("", nil).Track("asd", "kill", nil, nil)
+
+	require.Equal(t, []observation{
+		{QueueKindEvent, 1},
+		{QueueKindEvent, 2},
+		{QueueKindIdentifier, 1},
+		{QueueKindEvent, 3},
+	}, observations)
+}
+
 func TestSetIdentifiers(t *testing.T) {
 	t.Run("one identity", func(t *testing.T) {
 		errChan := make(chan error)
@@ -404,7 +839,7 @@ func TestSetIdentifiers(t *testing.T) {
 
 		requestCounter := 0
 
-		client.httpClient = &mockHttpClient{
+		client.transport.(*httpTransport).client = &mockHttpClient{
 			handle: func(req *http.Request) (*http.Response, error) {
 				defer wg.Done()
 
@@ -453,7 +888,7 @@ func TestSetIdentifiers(t *testing.T) {
 
 		requestCounter := 0
 
-		client.httpClient = &mockHttpClient{
+		client.transport.(*httpTransport).client = &mockHttpClient{
 			handle: func(req *http.Request) (*http.Response, error) {
 				defer wg.Done()
 
@@ -493,55 +928,1620 @@ func TestSetIdentifiers(t *testing.T) {
 
 		require.Equal(t, 2, requestCounter)
 	})
-}
 
-func TestRound(t *testing.T) {
-	t.Run("single track", func(t *testing.T) {
+	t.Run("without flush", func(t *testing.T) {
+		transport := NewMemoryTransport()
+
 		client := NewClientBuilder().
 			WithClientID("a").
 			WithClientSecret("b").
 			WithGameID("c").
-			WithFlushCooldown(5 * time.Second).
+			WithFlushCooldown(0).
+			WithFlushOnIdentifier(false).
+			WithTransport(transport).
 			Build()
 		defer client.Close()
 
-		client.httpClient = nil
+		client.SetIdentifiers("asd", &Identifiers{
+			DiscordID: IdentifierFrom("yope"),
+		})
 
-		r := client.StartRound("", nil)
-		require.NotEmpty(t, r.id)
-		r.Track("asd", "kill", PointerFrom(1), nil)
+		require.Len(t, client.identifierQueue, 1)
+		require.Nil(t, client.flushWaiting)
+		require.Empty(t, transport.Payloads())
 
-		e := &client.eventQueue[0]
-		require.Equal(t, e.UserID, "asd")
-		require.Equal(t, e.Event, "kill")
-		require.Equal(t, *e.Value, 1)
-		require.Equal(t, r.id, e.GroupID)
+		// The identifiers are sent with the next flush
+		require.Nil(t, client.Flush())
+		require.Len(t, transport.Identifiers(), 1)
 	})
+}
 
-	t.Run("single track with custom id", func(t *testing.T) {
-		client := NewClientBuilder().
-			WithClientID("a").
-			WithClientSecret("b").
-			WithGameID("c").
-			WithFlushCooldown(5 * time.Second).
-			Build()
-		defer client.Close()
+func TestWaitForFlush(t *testing.T) {
+	transport := NewMemoryTransport()
 
-		client.httpClient = nil
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushInterval(50 * time.Millisecond).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
 
-		r := client.StartRound("custom-id", nil)
-		require.Equal(t, "custom-id", r.id)
-		r.Track("asd", "kill", PointerFrom(1), nil)
+	done := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- client.WaitForFlush(ctx)
+	}()
 
-		e := &client.eventQueue[0]
-		require.Equal(t, e.UserID, "asd")
-		require.Equal(t, e.Event, "kill")
-		require.Equal(t, *e.Value, 1)
-		require.Equal(t, r.id, e.GroupID)
-	})
+	// Wait until the waiter is registered before anything is queued
+	awaitFlushWaiters(client, 1)
 
-	t.Run("multiple tracks", func(t *testing.T) {
-		client := NewClientBuilder().
+	client.Track("asd", "kill", nil, nil)
+
+	// The batch handler sends the event on its next tick
+	require.Nil(t, <-done)
+	require.Len(t, transport.Events(), 1)
+
+	// Nothing else is sent, so the context ends the wait
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, client.WaitForFlush(ctx))
+
+	client.flushWaitersLock.Lock()
+	require.Empty(t, client.flushWaiters)
+	client.flushWaitersLock.Unlock()
+}
+
+func TestSetFlushInterval(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushInterval(time.Hour).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	client.SetFlushInterval(20 * time.Millisecond)
+
+	done := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- client.WaitForFlush(ctx)
+	}()
+	awaitFlushWaiters(client, 1)
+
+	client.Track("asd", "kill", nil, nil)
+
+	// Without the reset, nothing would be sent for an hour
+	require.Nil(t, <-done)
+	require.Len(t, transport.Events(), 1)
+
+	require.PanicsWithValue(t, "flush interval must be at least 0", func() {
+		client.SetFlushInterval(-1)
+	})
+}
+
+func TestZeroFlushInterval(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushInterval(0).
+		WithBatchSize(2).
+		WithAsyncBatchFlush(false).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	client.Track("asd", "kill", nil, nil)
+
+	// Nothing is flushed without the interval
+	time.Sleep(50 * time.Millisecond)
+	require.Empty(t, transport.Payloads())
+
+	// The batch size still flushes the queue
+	client.Track("asd", "kill", nil, nil)
+	require.Len(t, transport.Events(), 2)
+
+	// The interval can be disabled and enabled at runtime
+	client.SetFlushInterval(10 * time.Millisecond)
+	client.SetFlushInterval(0)
+	client.Track("asd", "kill", nil, nil)
+	time.Sleep(50 * time.Millisecond)
+	require.Len(t, transport.Events(), 2)
+}
+
+// flakyTransport fails the sends with the given numbers, counting from 1.
+type flakyTransport struct {
+	*MemoryTransport
+	lock  sync.Mutex
+	sends int
+	fail  map[int]error
+}
+
+func (t *flakyTransport) Send(ctx context.Context, payload []byte, headers map[string]string) error {
+	t.lock.Lock()
+	t.sends++
+	err := t.fail[t.sends]
+	t.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return t.MemoryTransport.Send(ctx, payload, headers)
+}
+
+func TestFlushDrainsQueue(t *testing.T) {
+	errFirst, errThird := errors.New("first"), errors.New("third")
+
+	tests := []struct {
+		name   string
+		fail   map[int]error
+		sent   []int
+		queued []int
+	}{
+		{
+			name: "all sent",
+			sent: []int{0, 1, 2, 3, 4},
+		},
+		{
+			name:   "partially sent",
+			fail:   map[int]error{2: errThird},
+			sent:   []int{0, 1, 4},
+			queued: []int{2, 3},
+		},
+		{
+			name:   "multiple failures",
+			fail:   map[int]error{1: errFirst, 3: errThird},
+			sent:   []int{2, 3},
+			queued: []int{0, 1, 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &flakyTransport{MemoryTransport: NewMemoryTransport(), fail: tt.fail}
+
+			client := NewClientBuilder().
+				WithClientID("a").
+				WithClientSecret("b").
+				WithGameID("c").
+				WithBatchSize(2).
+				WithFlushCooldown(0).
+				WithTransport(transport).
+				Build()
+			defer client.Close()
+
+			for i := 0; i < 5; i++ {
+				client.eventQueue = append(client.eventQueue, Event{UserID: "asd", Event: "kill", Value: PointerFrom(i)})
+			}
+
+			err := client.Flush()
+			for _, failure := range tt.fail {
+				require.True(t, errors.Is(err, failure))
+			}
+			if tt.fail == nil {
+				require.Nil(t, err)
+			}
+
+			var sent, queued []int
+			for _, e := range transport.Events() {
+				sent = append(sent, *e.Value)
+			}
+			for _, e := range client.eventQueue {
+				queued = append(queued, *e.Value)
+			}
+			require.Equal(t, tt.sent, sent)
+			require.Equal(t, tt.queued, queued)
+		})
+	}
+}
+
+func TestMaxBatchesPerFlush(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithBatchSize(2).
+		WithFlushCooldown(0).
+		WithMaxBatchesPerFlush(2).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	for i := 0; i < 5; i++ {
+		client.eventQueue = append(client.eventQueue, Event{UserID: "asd", Event: "kill", Value: PointerFrom(i)})
+	}
+
+	require.Nil(t, client.Flush())
+	require.Len(t, transport.Payloads(), 2)
+	require.Len(t, client.eventQueue, 1)
+
+	// The rest is sent with the next flush
+	require.Nil(t, client.Flush())
+	require.Len(t, transport.Payloads(), 3)
+	require.Empty(t, client.eventQueue)
+
+	require.PanicsWithValue(t, "max batches per flush must be at least 1", func() {
+		NewClientBuilder().WithMaxBatchesPerFlush(0)
+	})
+}
+
+func TestSetBatchSize(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithBatchSize(10).
+		WithAsyncBatchFlush(false).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	for i := 0; i < 3; i++ {
+		client.Track("asd", "kill", PointerFrom(i), nil)
+	}
+	require.Empty(t, transport.Payloads())
+
+	// The queue already holds a full batch of the new size,
+	// so it is drained in batches of the new size
+	client.SetBatchSize(2)
+
+	require.Len(t, transport.Payloads(), 2)
+	require.Len(t, transport.Events(), 3)
+	require.Empty(t, client.eventQueue)
+
+	// The next events fill the batch again
+	client.Track("asd", "kill", PointerFrom(3), nil)
+	require.Len(t, transport.Payloads(), 2)
+	client.Track("asd", "kill", PointerFrom(4), nil)
+	require.Len(t, transport.Payloads(), 3)
+	require.Empty(t, client.eventQueue)
+
+	require.PanicsWithValue(t, "batch size must be at least 1", func() {
+		client.SetBatchSize(0)
+	})
+
+	client.minFlushBatch = 2
+	require.PanicsWithValue(t, "batch size cannot be less than WithMinFlushBatch", func() {
+		client.SetBatchSize(1)
+	})
+}
+
+// awaitFlushWaiters waits until n callers are blocked in WaitForFlush.
+func awaitFlushWaiters(client *Client, n int) {
+	for {
+		client.flushWaitersLock.Lock()
+		waiting := len(client.flushWaiters)
+		client.flushWaitersLock.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClientClosed(t *testing.T) {
+	errChan := make(chan error, 2)
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithErrorChannel(errChan).
+		Build()
+
+	client.transport = nil
+
+	client.Close()
+	// Closing again does nothing
+	client.Close()
+
+	client.Track("asd", "kill", nil, nil)
+	client.SetIdentifiers("asd", &Identifiers{})
+	require.Equal(t, ErrClientClosed, <-errChan)
+	require.Equal(t, ErrClientClosed, <-errChan)
+	require.Empty(t, client.eventQueue)
+	require.Empty(t, client.identifierQueue)
+
+	require.Equal(t, ErrClientClosed, client.Flush())
+	require.Equal(t, ErrClientClosed, client.FlushUser(context.Background(), "asd"))
+	require.Equal(t, ErrClientClosed, client.WaitForFlush(context.Background()))
+	require.Equal(t, ErrClientClosed, client.Ping(context.Background()))
+	require.Equal(t, ErrClientClosed, client.StartRound("", nil).TrackContext(context.Background(), "asd", "kill", nil, nil))
+}
+
+func TestBatchComposition(t *testing.T) {
+	testCases := []struct {
+		name        string
+		composition BatchComposition
+		identifiers int
+		events      int
+		// The number of identifiers and events in each batch
+		batches [][2]int
+	}{
+		{
+			name:        "identifiers first",
+			composition: BatchCompositionIdentifiersFirst,
+			identifiers: 5,
+			events:      3,
+			batches:     [][2]int{{4, 0}, {1, 3}},
+		},
+		{
+			name:        "events first",
+			composition: BatchCompositionEventsFirst,
+			identifiers: 5,
+			events:      3,
+			batches:     [][2]int{{1, 3}, {4, 0}},
+		},
+		{
+			name:        "interleaved",
+			composition: BatchCompositionInterleaved,
+			identifiers: 5,
+			events:      3,
+			batches:     [][2]int{{2, 2}, {3, 1}},
+		},
+		{
+			name:        "interleaved with few identifiers",
+			composition: BatchCompositionInterleaved,
+			identifiers: 1,
+			events:      6,
+			batches:     [][2]int{{1, 3}, {0, 3}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := NewMemoryTransport()
+
+			client := NewClientBuilder().
+				WithClientID("a").
+				WithClientSecret("b").
+				WithGameID("c").
+				WithFlushCooldown(5 * time.Second).
+				WithBatchSize(4).
+				WithBatchComposition(tc.composition).
+				WithTransport(transport).
+				Build()
+			defer client.Close()
+
+			client.queueLock.Lock()
+			for i := 0; i < tc.identifiers; i++ {
+				client.identifierQueue = append(client.identifierQueue, UserIdentifiers{UserID: strconv.Itoa(i)})
+			}
+			for i := 0; i < tc.events; i++ {
+				client.eventQueue = append(client.eventQueue, Event{UserID: strconv.Itoa(i), Event: "kill"})
+			}
+			client.queueLock.Unlock()
+
+			for range tc.batches {
+				require.Nil(t, client.process(context.Background(), FlushTriggerExplicit))
+			}
+			require.Empty(t, client.identifierQueue)
+			require.Empty(t, client.eventQueue)
+
+			payloads := transport.Payloads()
+			require.Len(t, payloads, len(tc.batches))
+			for i, batch := range tc.batches {
+				var p payload
+				require.Nil(t, json.Unmarshal(payloads[i], &p))
+				require.Len(t, p.Identifiers, batch[0], "identifiers of batch %d", i)
+				require.Len(t, p.Events, batch[1], "events of batch %d", i)
+			}
+		})
+	}
+}
+
+func TestClosedErrorChannel(t *testing.T) {
+	errChan := make(chan error)
+	close(errChan)
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithErrorChannel(errChan).
+		Build()
+
+	require.NotPanics(t, func() {
+		client.reportError(errors.New("failed"))
+
+		// Tracking after Close reports ErrClientClosed
+		client.Close()
+		client.Track("asd", "kill", nil, nil)
+	})
+}
+
+func TestFlushWithOutcome(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithTransport(transport).
+		Build()
+
+	client.Track("asd", "kill", nil, nil)
+
+	outcome, err := client.FlushWithOutcome()
+	require.Nil(t, err)
+	require.Equal(t, FlushOutcomeSent, outcome)
+	require.Len(t, transport.Events(), 1)
+
+	client.Track("asd", "kill", nil, nil)
+
+	outcome, err = client.FlushWithOutcome()
+	require.Nil(t, err)
+	require.Equal(t, FlushOutcomeScheduled, outcome)
+
+	outcome, err = client.FlushWithOutcome()
+	require.Nil(t, err)
+	require.Equal(t, FlushOutcomeSkipped, outcome)
+
+	client.Close()
+
+	outcome, err = client.FlushWithOutcome()
+	require.Equal(t, ErrClientClosed, err)
+	require.Equal(t, FlushOutcomeSkipped, outcome)
+}
+
+func TestZeroFlushCooldown(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	for i := 1; i <= 3; i++ {
+		client.Track("asd", "kill", nil, nil)
+
+		outcome, err := client.FlushWithOutcome()
+		require.Nil(t, err)
+		require.Equal(t, FlushOutcomeSent, outcome)
+		require.Len(t, transport.Payloads(), i)
+		require.Nil(t, client.flushWaiting)
+	}
+
+	client.Track("asd", "kill", nil, nil)
+	require.Nil(t, client.FlushBlocking(context.Background()))
+	require.Len(t, transport.Payloads(), 4)
+	require.Nil(t, client.flushWaiting)
+}
+
+func TestTrackMetrics(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	client.TrackMetrics("asd", "kill", map[string]float64{"damage": 12.5, "distance": 40}, Traits{"weapon": "bow"})
+	client.Track("asd", "kill", PointerFrom(1), nil)
+	require.Nil(t, client.Flush())
+
+	events := transport.Events()
+	require.Len(t, events, 2)
+	require.Equal(t, map[string]float64{"damage": 12.5, "distance": 40}, events[0].Metrics)
+	require.Nil(t, events[0].Value)
+	require.Equal(t, "bow", events[0].Traits["weapon"])
+	require.Nil(t, events[1].Metrics)
+
+	payload := string(transport.Payloads()[0])
+	require.Contains(t, payload, `"traits":{"weapon":"bow"},"metrics":{"damage":12.5,"distance":40}`)
+	require.Equal(t, 1, strings.Count(payload, "metrics"))
+}
+
+func TestEventFilter(t *testing.T) {
+	for _, filterStartGame := range []bool{false, true} {
+		transport := NewMemoryTransport()
+
+		client := NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithFlushCooldown(0).
+			WithBatchSize(2).
+			WithAsyncBatchFlush(false).
+			WithTransport(transport).
+			WithEventNameTransform(strings.ToUpper).
+			WithEventFilter(func(e Event) bool {
+				return !strings.HasPrefix(e.Event, "DEBUG_") && e.Event != StartGameEvent
+			}).
+			WithStartGameFiltered(filterStartGame).
+			Build()
+
+		client.Track("asd", "debug_position", nil, nil)
+		client.StartRound("", nil).Track("asd", "debug_position", nil, nil)
+		require.Nil(t, client.StartRound("", nil).TrackContext(context.Background(), "asd", "debug_position", nil, nil))
+		require.Nil(t, client.TrackRaw(Event{UserID: "asd", Event: "DEBUG_POSITION", Time: time.Now().Format(time.RFC3339)}))
+
+		// The filtered events never fill the batch
+		require.Empty(t, client.eventQueue)
+
+		client.Track("asd", "kill", nil, nil)
+		client.StartGame("asd")
+		require.Nil(t, client.Flush())
+
+		var names []string
+		for _, e := range transport.Events() {
+			names = append(names, e.Event)
+		}
+		if filterStartGame {
+			require.Equal(t, []string{"KILL"}, names)
+		} else {
+			require.Equal(t, []string{"KILL", StartGameEvent}, names)
+		}
+
+		client.Close()
+	}
+}
+
+func TestTimeFunc(t *testing.T) {
+	transport := NewMemoryTransport()
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithTransport(transport).
+		WithTimeFunc(func() time.Time { return now }).
+		Build()
+	defer client.Close()
+
+	client.Track("asd", "kill", nil, nil)
+	client.StartGame("asd")
+	client.TrackError("asd", errors.New("failed"), nil)
+	client.StartRound("", nil).Track("asd", "kill", nil, nil)
+	require.Nil(t, client.Flush())
+
+	events := transport.Events()
+	require.Len(t, events, 4)
+	for _, e := range events {
+		require.Equal(t, "2024-01-02T03:04:05Z", e.Time)
+	}
+
+	require.PanicsWithValue(t, "time func cannot be nil", func() {
+		NewClientBuilder().WithTimeFunc(nil)
+	})
+}
+
+func TestSchema(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithDefaultSchema("v1").
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	client.Track("asd", "kill", nil, nil)
+	client.StartRound("", nil).Track("asd", "kill", nil, nil)
+	client.TrackWithSchema("v2", "asd", "kill", nil, nil)
+
+	require.Nil(t, client.Flush())
+
+	events := transport.Events()
+	require.Len(t, events, 3)
+	require.Equal(t, "v1", events[0].Schema)
+	require.Equal(t, "v1", events[1].Schema)
+	require.Equal(t, "v2", events[2].Schema)
+
+	// The schema is left out if there is none
+	client.defaultSchema = ""
+	transport.Reset()
+	client.Track("asd", "kill", nil, nil)
+	require.Nil(t, client.Flush())
+	require.NotContains(t, string(transport.Payloads()[0]), "schema")
+}
+
+func TestTrackRaw(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithGlobalTraits(Traits{"server": "eu"}).
+		WithEventNameTransform(strings.ToUpper).
+		WithDefaultSchema("v1").
+		Build()
+	defer client.Close()
+
+	client.transport = nil
+
+	e := Event{
+		UserID:  "asd",
+		Time:    "2020-01-02T03:04:05Z",
+		Event:   "kill",
+		GroupID: "original-round",
+		Value:   PointerFrom(1),
+	}
+	require.Nil(t, client.TrackRaw(e))
+	require.Equal(t, e, client.eventQueue[0])
+
+	for _, invalid := range []Event{
+		{Time: e.Time, Event: "kill"},
+		{UserID: "asd", Time: e.Time},
+		{UserID: "asd", Event: "kill"},
+		{UserID: "asd", Event: "kill", Time: "yesterday"},
+	} {
+		require.NotNil(t, client.TrackRaw(invalid))
+	}
+	require.Len(t, client.eventQueue, 1)
+}
+
+func TestForceFlush(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(200 * time.Millisecond).
+		WithTransport(transport).
+		Build()
+
+	client.Track("asd", "kill", nil, nil)
+	require.Nil(t, client.Flush())
+
+	client.Track("asd", "kill", nil, nil)
+	outcome, err := client.FlushWithOutcome()
+	require.Nil(t, err)
+	require.Equal(t, FlushOutcomeScheduled, outcome)
+
+	// The waiting flush is canceled
+	require.Nil(t, client.ForceFlush(context.Background()))
+	require.Len(t, transport.Payloads(), 2)
+	require.Nil(t, client.flushWaiting)
+
+	// The cooldown starts over
+	client.Track("asd", "kill", nil, nil)
+	outcome, err = client.FlushWithOutcome()
+	require.Nil(t, err)
+	require.Equal(t, FlushOutcomeScheduled, outcome)
+
+	time.Sleep(300 * time.Millisecond)
+	require.Len(t, transport.Payloads(), 3)
+
+	client.Close()
+	require.Equal(t, ErrClientClosed, client.ForceFlush(context.Background()))
+}
+
+// contextTransport records a value of the contexts it sends with.
+type contextTransport struct {
+	*MemoryTransport
+	lock   sync.Mutex
+	values []any
+}
+
+type contextKey struct{}
+
+func (t *contextTransport) Send(ctx context.Context, payload []byte, headers map[string]string) error {
+	t.lock.Lock()
+	t.values = append(t.values, ctx.Value(contextKey{}))
+	t.lock.Unlock()
+	return t.MemoryTransport.Send(ctx, payload, headers)
+}
+
+func TestBaseContext(t *testing.T) {
+	transport := &contextTransport{MemoryTransport: NewMemoryTransport()}
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithBatchSize(2).
+		WithAsyncBatchFlush(false).
+		WithTransport(transport).
+		WithBaseContext(func() context.Context {
+			return context.WithValue(context.Background(), contextKey{}, "base")
+		}).
+		Build()
+	defer client.Close()
+
+	// Flush
+	client.Track("asd", "kill", nil, nil)
+	require.Nil(t, client.Flush())
+
+	// Batch size
+	client.Track("asd", "kill", nil, nil)
+	client.Track("asd", "kill", nil, nil)
+
+	// A context that is passed is used instead
+	client.Track("asd", "kill", nil, nil)
+	ctx := context.WithValue(context.Background(), contextKey{}, "passed")
+	require.Nil(t, client.ForceFlush(ctx))
+
+	require.Equal(t, []any{"base", "base", "passed"}, transport.values)
+}
+
+func TestTriggerFlush(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushInterval(time.Hour).
+		WithFlushCooldown(time.Hour).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	// Start the cooldown, which TriggerFlush ignores
+	require.Nil(t, client.Flush())
+
+	done := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- client.WaitForFlush(ctx)
+	}()
+	awaitFlushWaiters(client, 1)
+
+	client.Track("asd", "kill", nil, nil)
+	client.TriggerFlush()
+
+	require.Nil(t, <-done)
+	require.Len(t, transport.Events(), 1)
+}
+
+func TestFlushBlocking(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(200 * time.Millisecond).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	// Start the cooldown
+	require.Nil(t, client.Flush())
+
+	client.Track("asd", "kill", nil, nil)
+	// This starts the waiter, which FlushBlocking takes over
+	require.Nil(t, client.Flush())
+
+	begin := time.Now()
+	require.Nil(t, client.FlushBlocking(context.Background()))
+	require.True(t, time.Since(begin) > 150*time.Millisecond)
+	require.Len(t, transport.Events(), 1)
+	require.Nil(t, client.flushWaiting)
+
+	// The context ends the wait for the cooldown
+	client.Track("asd", "kill", nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, client.FlushBlocking(ctx))
+	require.Len(t, client.eventQueue, 1)
+
+	// Without a waiter, nothing is sent until the next flush
+	require.Nil(t, client.flushWaiting)
+
+	// The error of sending is returned
+	client.transport = &httpTransport{dsn: client.dsn, client: &mockHttpClient{
+		handle: func(req *http.Request) (*http.Response, error) {
+			return nil, fmt.Errorf("offline")
+		},
+	}}
+	err := client.FlushBlocking(context.Background())
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "offline")
+}
+
+func TestCoalesceIdentifierRemovals(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithTransport(transport).
+		WithFlushOnIdentifier(false).
+		WithCoalesceIdentifierRemovals(true).
+		Build()
+	defer client.Close()
+
+	removal := NewIdentifiers().Remove(DiscordID).Build()
+	for i := 0; i < 3; i++ {
+		client.SetIdentifiers("asd", removal)
+	}
+	// Another user's removal isn't redundant
+	client.SetIdentifiers("qwe", removal)
+	require.Nil(t, client.Flush())
+
+	require.Equal(t, `{"gameId":"c","events":[],"identifiers":[`+
+		`{"userId":"asd","discordId":null},{"userId":"qwe","discordId":null}]}`, string(transport.Payloads()[0]))
+	transport.Reset()
+
+	// A removal after setting the identifier is kept, and the rest of an update is kept
+	client.SetIdentifiers("asd", removal)
+	client.SetIdentifiers("asd", NewIdentifiers().Discord("d").Build())
+	client.SetIdentifiers("asd", removal)
+	client.SetIdentifiers("asd", NewIdentifiers().Remove(DiscordID).Steam("s").Build())
+	require.Nil(t, client.Flush())
+
+	require.Equal(t, `{"gameId":"c","events":[],"identifiers":[`+
+		`{"userId":"asd","discordId":null},{"userId":"asd","discordId":"d"},`+
+		`{"userId":"asd","discordId":null},{"userId":"asd","steamId":"s"}]}`, string(transport.Payloads()[0]))
+
+	// The identifiers that were passed are left as they are
+	require.Equal(t, RemoveIdentifier(), removal.DiscordID)
+}
+
+func TestRemoveIdentifiersBatch(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	client.RemoveIdentifiersBatch([]string{"a", "b", "c"}, DiscordID, SteamID)
+
+	// All updates are sent with a single flush
+	payloads := transport.Payloads()
+	require.Len(t, payloads, 1)
+	require.Contains(t, string(payloads[0]), `{"userId":"b","discordId":null,"steamId":null}`)
+
+	identifiers := transport.Identifiers()
+	require.Len(t, identifiers, 3)
+	for i, userID := range []string{"a", "b", "c"} {
+		require.Equal(t, userID, identifiers[i].UserID)
+	}
+
+	// Without fields, all identifiers are removed
+	transport.Reset()
+	client.RemoveIdentifiersBatch([]string{"a"})
+	require.Equal(t,
+		`{"gameId":"c","events":[],"identifiers":[{"userId":"a","appleId":null,"discordId":null,`+
+			`"email":null,"epicGamesId":null,"steamId":null,"twitterId":null,"walletAddress":null}]}`,
+		string(transport.Payloads()[0]))
+
+	require.Panics(t, func() {
+		client.RemoveIdentifiersBatch([]string{"a"}, IdentifierField("unknown"))
+	})
+}
+
+func TestFlushUser(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithBatchSize(3).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	// Start the cooldown, which FlushUser ignores
+	require.Nil(t, client.Flush())
+
+	client.Track("vip", "kill", PointerFrom(1), nil)
+	client.Track("other", "kill", PointerFrom(2), nil)
+	client.appendIdentifier(&UserIdentifiers{UserID: "vip"})
+	client.Track("vip", "kill", PointerFrom(3), nil)
+
+	err := client.FlushUser(context.Background(), "vip")
+	require.Nil(t, err)
+
+	// All three items of the user fit into one batch
+	require.Len(t, transport.Payloads(), 1)
+	events := transport.Events()
+	require.Len(t, events, 2)
+	for _, e := range events {
+		require.Equal(t, "vip", e.UserID)
+	}
+	require.Len(t, transport.Identifiers(), 1)
+
+	require.Len(t, client.eventQueue, 1)
+	require.Equal(t, "other", client.eventQueue[0].UserID)
+	require.Empty(t, client.identifierQueue)
+
+	// Nothing is queued for the user anymore
+	require.Nil(t, client.FlushUser(context.Background(), "vip"))
+	require.Len(t, transport.Payloads(), 1)
+}
+
+func TestFlushUserBatches(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithBatchSize(2).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	client.queueLock.Lock()
+	for i := 0; i < 3; i++ {
+		client.eventQueue = append(client.eventQueue, Event{UserID: "vip", Event: "kill"})
+	}
+	client.queueLock.Unlock()
+
+	require.Nil(t, client.FlushUser(context.Background(), "vip"))
+	require.Len(t, transport.Payloads(), 2)
+	require.Len(t, transport.Events(), 3)
+}
+
+func TestFlushUserFailure(t *testing.T) {
+	errFail := errors.New("fail")
+	transport := &flakyTransport{MemoryTransport: NewMemoryTransport(), fail: map[int]error{1: errFail, 2: errFail}}
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	client.Track("vip", "kill", nil, nil)
+	client.appendIdentifier(&UserIdentifiers{UserID: "vip"})
+	r := client.StartRound("round", nil)
+	r.Track("other", "kill", nil, nil)
+
+	// The items that couldn't be sent stay queued
+	require.True(t, errors.Is(client.FlushUser(context.Background(), "vip"), errFail))
+	require.True(t, errors.Is(r.Flush(context.Background()), errFail))
+	require.Len(t, client.eventQueue, 2)
+	require.Len(t, client.identifierQueue, 1)
+	require.Equal(t, uint64(0), client.Stats().Dropped)
+
+	require.Nil(t, client.FlushUser(context.Background(), "vip"))
+	require.Nil(t, r.Flush(context.Background()))
+	require.Len(t, transport.Events(), 2)
+	require.Len(t, transport.Identifiers(), 1)
+	require.Empty(t, client.eventQueue)
+}
+
+func TestPurgeUser(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		Build()
+	defer client.Close()
+
+	client.transport = nil
+
+	client.Track("deleted", "kill", nil, nil)
+	client.Track("other", "kill", nil, nil)
+	client.appendIdentifier(&UserIdentifiers{UserID: "deleted"})
+	client.appendIdentifier(&UserIdentifiers{UserID: "other"})
+
+	client.PurgeUser("deleted")
+
+	require.Len(t, client.eventQueue, 1)
+	require.Equal(t, "other", client.eventQueue[0].UserID)
+	require.Len(t, client.identifierQueue, 1)
+	require.Equal(t, "other", client.identifierQueue[0].UserID)
+}
+
+func TestPurgeQueue(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		Build()
+	defer client.Close()
+
+	client.transport = nil
+
+	events, identifiers := client.PurgeQueue()
+	require.Equal(t, 0, events)
+	require.Equal(t, 0, identifiers)
+
+	client.Track("asd", "kill", nil, nil)
+	client.StartGame("asd")
+	client.appendIdentifier(&UserIdentifiers{UserID: "asd"})
+
+	events, identifiers = client.PurgeQueue()
+	require.Equal(t, 2, events)
+	require.Equal(t, 1, identifiers)
+	require.Empty(t, client.eventQueue)
+	require.Empty(t, client.identifierQueue)
+
+	// Nothing is sent after purging
+	require.Nil(t, client.Flush())
+}
+
+func TestRetry(t *testing.T) {
+	testCases := []struct {
+		name             string
+		builder          func(cb *ClientBuilder) *ClientBuilder
+		expectedRequests int32
+	}{
+		{
+			name: "without retry",
+			builder: func(cb *ClientBuilder) *ClientBuilder {
+				return cb.WithoutRetry()
+			},
+			expectedRequests: 1,
+		},
+		{
+			name: "without retry overrides max retry attempts",
+			builder: func(cb *ClientBuilder) *ClientBuilder {
+				return cb.WithMaxRetryAttempts(3).WithoutRetry()
+			},
+			expectedRequests: 1,
+		},
+		{
+			name: "max retry attempts",
+			builder: func(cb *ClientBuilder) *ClientBuilder {
+				return cb.WithMaxRetryAttempts(1)
+			},
+			expectedRequests: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var requestCounter atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requestCounter.Add(1)
+				w.WriteHeader(http.StatusInternalServerError)
+			}))
+			defer server.Close()
+
+			client := tc.builder(NewClientBuilder().
+				WithClientID("a").
+				WithClientSecret("b").
+				WithGameID("c").
+				WithDSN(server.URL).
+				WithAllowInsecureHTTP().
+				WithFlushCooldown(5 * time.Second)).
+				Build()
+			defer client.Close()
+
+			client.Track("asd", "kill", nil, nil)
+
+			err := client.Flush()
+			require.NotNil(t, err)
+			require.Equal(t, tc.expectedRequests, requestCounter.Load())
+		})
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	var requestCounter atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestCounter.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithDSN(server.URL).
+		WithAllowInsecureHTTP().
+		WithFlushCooldown(5 * time.Second).
+		WithMaxRetryAttempts(3).
+		WithRetryWaitMin(10 * time.Millisecond).
+		WithRetryWaitMax(20 * time.Millisecond).
+		Build()
+	defer client.Close()
+
+	client.Track("asd", "kill", nil, nil)
+
+	// With the default waits, the retries would take 7 seconds
+	begin := time.Now()
+	require.NotNil(t, client.Flush())
+	require.Equal(t, int32(4), requestCounter.Load())
+	require.True(t, time.Since(begin) < time.Second)
+
+	require.PanicsWithValue(t, "retry wait min cannot be greater than retry wait max", func() {
+		NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithRetryWaitMin(time.Second).
+			WithRetryWaitMax(time.Millisecond).
+			Build()
+	})
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("hang") {
+			time.Sleep(time.Second)
+		}
+		fmt.Fprint(w, `{"message":"OK"}`)
+	}))
+	defer server.Close()
+
+	newClient := func(dsn string) *Client {
+		return NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithDSN(dsn).
+			WithAllowInsecureHTTP().
+			WithFlushCooldown(0).
+			WithoutRetry().
+			WithResponseHeaderTimeout(100 * time.Millisecond).
+			Build()
+	}
+
+	t.Run("in time", func(t *testing.T) {
+		client := newClient(server.URL)
+		defer client.Close()
+
+		client.Track("asd", "kill", nil, nil)
+		require.Nil(t, client.Flush())
+	})
+
+	t.Run("hanging server", func(t *testing.T) {
+		client := newClient(server.URL + "?hang=1")
+		defer client.Close()
+
+		client.Track("asd", "kill", nil, nil)
+
+		begin := time.Now()
+		require.NotNil(t, client.Flush())
+		require.True(t, time.Since(begin) < time.Second)
+	})
+
+	require.Zero(t, http.DefaultTransport.(*http.Transport).ResponseHeaderTimeout)
+}
+
+func TestFlushDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithDSN(server.URL).
+		WithAllowInsecureHTTP().
+		WithFlushCooldown(0).
+		WithMaxRetryAttempts(10).
+		WithRetryWaitMin(50 * time.Millisecond).
+		WithRetryWaitMax(50 * time.Millisecond).
+		WithFlushDeadline(120 * time.Millisecond).
+		Build()
+	defer client.Close()
+
+	client.Track("asd", "kill", nil, nil)
+
+	// Without the deadline, the retries would take half a second
+	begin := time.Now()
+	err := client.Flush()
+	require.True(t, errors.Is(err, context.DeadlineExceeded))
+	require.True(t, time.Since(begin) < 400*time.Millisecond)
+
+	// The event is kept for the next flush
+	require.Len(t, client.eventQueue, 1)
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	var lock sync.Mutex
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		keys = append(keys, r.Header.Get("x-idempotency-key"))
+		attempt := len(keys)
+		lock.Unlock()
+
+		// The first attempt of the first batch fails
+		if attempt == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"message":"OK"}`)
+	}))
+	defer server.Close()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithDSN(server.URL).
+		WithAllowInsecureHTTP().
+		WithFlushCooldown(0).
+		WithRetryWaitMin(time.Millisecond).
+		WithRetryWaitMax(time.Millisecond).
+		Build()
+	defer client.Close()
+
+	client.Track("asd", "kill", nil, nil)
+	require.Nil(t, client.Flush())
+	client.Track("asd", "kill", nil, nil)
+	require.Nil(t, client.Flush())
+
+	// The retry reuses the key, the next batch has its own
+	require.Len(t, keys, 3)
+	require.NotEmpty(t, keys[0])
+	require.Equal(t, keys[0], keys[1])
+	require.NotEqual(t, keys[1], keys[2])
+}
+
+// headerTransport records the headers of the last payload it sent.
+type headerTransport struct {
+	*MemoryTransport
+	headers map[string]string
+}
+
+func (t *headerTransport) Send(ctx context.Context, payload []byte, headers map[string]string) error {
+	t.headers = headers
+	return t.MemoryTransport.Send(ctx, payload, headers)
+}
+
+func TestAuthHeaderNames(t *testing.T) {
+	transport := &headerTransport{MemoryTransport: NewMemoryTransport()}
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithTransport(transport).
+		WithAuthHeaderNames("X-EA-Client-Id", "X-EA-Timestamp", "X-EA-Signature").
+		Build()
+	defer client.Close()
+
+	client.Track("asd", "kill", nil, nil)
+	require.Nil(t, client.Flush())
+
+	require.Equal(t, "a", transport.headers["X-EA-Client-Id"])
+	require.NotEmpty(t, transport.headers["X-EA-Timestamp"])
+	signature, err := client.sign(transport.Payloads()[0], transport.headers["X-EA-Timestamp"])
+	require.Nil(t, err)
+	require.Equal(t, signature, transport.headers["X-EA-Signature"])
+	require.NotContains(t, transport.headers, "x-client-id")
+	require.NotContains(t, transport.headers, "x-timestamp")
+	require.NotContains(t, transport.headers, "x-signature")
+
+	require.PanicsWithValue(t, "auth header names cannot be empty", func() {
+		NewClientBuilder().WithAuthHeaderNames("a", "", "c")
+	})
+	require.PanicsWithValue(t, "auth header names must be distinct", func() {
+		NewClientBuilder().WithAuthHeaderNames("a", "b", "A")
+	})
+}
+
+func TestName(t *testing.T) {
+	for _, name := range []string{"", "eu-west"} {
+		transport := &headerTransport{MemoryTransport: NewMemoryTransport()}
+
+		client := NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithFlushCooldown(0).
+			WithTransport(transport).
+			WithName(name).
+			Build()
+
+		client.Track("asd", "kill", nil, nil)
+		require.Nil(t, client.Flush())
+
+		require.Equal(t, name, client.Stats().Name)
+		require.Equal(t, name, client.Config().Name)
+		header, ok := transport.headers["x-client-name"]
+		require.Equal(t, name != "", ok)
+		require.Equal(t, name, header)
+
+		client.Close()
+	}
+}
+
+func TestJitterBackoff(t *testing.T) {
+	min, max := 100*time.Millisecond, 10*time.Second
+
+	waits := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		// The exponential wait of the third attempt is 800ms
+		wait := jitterBackoff(min, max, 3, nil)
+		require.True(t, wait >= min && wait <= 800*time.Millisecond, wait)
+		waits[wait] = true
+	}
+	require.True(t, len(waits) > 1)
+
+	// The wait requested by the server is kept
+	resp := &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"Retry-After": []string{"2"}},
+	}
+	require.Equal(t, 2*time.Second, jitterBackoff(min, max, 3, resp))
+}
+
+// roundTripperFunc is an http.RoundTripper that calls the function.
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestHTTPTapRequestUnchanged(t *testing.T) {
+	var sent, tapped string
+	transport := &tapTransport{
+		next: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			b, err := io.ReadAll(req.Body)
+			require.Nil(t, err)
+			sent = string(b)
+			return &http.Response{Body: io.NopCloser(strings.NewReader(`{"message":"OK"}`))}, nil
+		}),
+		tap: func(req *http.Request, res *http.Response, err error) {
+			b, _ := io.ReadAll(req.Body)
+			tapped = string(b)
+		},
+	}
+
+	body := io.NopCloser(strings.NewReader("payload"))
+	req, err := http.NewRequest("POST", "https://example.com", body)
+	require.Nil(t, err)
+
+	_, err = transport.RoundTrip(req)
+	require.Nil(t, err)
+	require.Equal(t, "payload", sent)
+	require.Equal(t, "payload", tapped)
+	// The body of the caller's request isn't replaced
+	require.True(t, req.Body == body)
+}
+
+func TestHTTPTap(t *testing.T) {
+	var requestCounter atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		require.Contains(t, string(b), `"event":"kill"`)
+
+		if requestCounter.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"message":"OK"}`)
+	}))
+	defer server.Close()
+
+	type attempt struct {
+		reqBody, resBody string
+		signature        string
+		statusCode       int
+	}
+	var attempts []attempt
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithDSN(server.URL).
+		WithAllowInsecureHTTP().
+		WithMaxRetryAttempts(1).
+		WithFlushCooldown(5 * time.Second).
+		WithHTTPTap(func(req *http.Request, res *http.Response, err error) {
+			require.Nil(t, err)
+
+			reqBody, err := io.ReadAll(req.Body)
+			require.Nil(t, err)
+			resBody, err := io.ReadAll(res.Body)
+			require.Nil(t, err)
+
+			attempts = append(attempts, attempt{
+				reqBody:    string(reqBody),
+				resBody:    string(resBody),
+				signature:  req.Header.Get("x-signature"),
+				statusCode: res.StatusCode,
+			})
+		}).
+		Build()
+	defer client.Close()
+
+	client.Track("asd", "kill", nil, nil)
+
+	err := client.Flush()
+	require.Nil(t, err)
+	require.Equal(t, int32(2), requestCounter.Load())
+
+	require.Len(t, attempts, 2)
+	require.Equal(t, http.StatusInternalServerError, attempts[0].statusCode)
+	require.Equal(t, http.StatusOK, attempts[1].statusCode)
+	require.Equal(t, `{"message":"OK"}`, attempts[1].resBody)
+	for _, a := range attempts {
+		require.Contains(t, a.reqBody, `"event":"kill"`)
+		require.NotEmpty(t, a.signature)
+	}
+}
+
+func TestIdentifiersDuringCooldown(t *testing.T) {
+	t.Run("identifiers set during cooldown are sent by the waiter", func(t *testing.T) {
+		client := NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithFlushCooldown(300 * time.Millisecond).
+			WithFlushInterval(time.Hour).
+			Build()
+		defer client.Close()
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+
+		var lock sync.Mutex
+		var bodies []string
+
+		client.transport.(*httpTransport).client = &mockHttpClient{
+			handle: func(req *http.Request) (*http.Response, error) {
+				defer wg.Done()
+
+				b, err := io.ReadAll(req.Body)
+				require.Nil(t, err)
+
+				lock.Lock()
+				bodies = append(bodies, string(b))
+				lock.Unlock()
+
+				return &http.Response{
+					Body: io.NopCloser(strings.NewReader(`{"message":"OK"}`)),
+				}, nil
+			},
+		}
+
+		// Starts the cooldown
+		client.SetIdentifiers("user-0", &Identifiers{DiscordID: IdentifierFrom("d0")})
+
+		// These start the waiter once and then return early
+		for i := 1; i <= 3; i++ {
+			client.SetIdentifiers("user-"+strconv.Itoa(i), &Identifiers{DiscordID: IdentifierFrom("d" + strconv.Itoa(i))})
+			require.Nil(t, client.Flush())
+		}
+
+		wg.Wait()
+
+		require.Len(t, bodies, 2)
+		require.Contains(t, bodies[0], `"userId":"user-0"`)
+		for i := 1; i <= 3; i++ {
+			require.Contains(t, bodies[1], `"userId":"user-`+strconv.Itoa(i)+`"`)
+		}
+		require.Empty(t, client.identifierQueue)
+	})
+
+	t.Run("identifiers that don't fit into one batch are drained by the waiter", func(t *testing.T) {
+		client := NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithBatchSize(2).
+			WithFlushCooldown(100 * time.Millisecond).
+			WithFlushInterval(time.Hour).
+			Build()
+		defer client.Close()
+
+		var wg sync.WaitGroup
+		wg.Add(3)
+
+		var requestCounter atomic.Int32
+
+		client.transport.(*httpTransport).client = &mockHttpClient{
+			handle: func(req *http.Request) (*http.Response, error) {
+				defer wg.Done()
+				requestCounter.Add(1)
+
+				return &http.Response{
+					Body: io.NopCloser(strings.NewReader(`{"message":"OK"}`)),
+				}, nil
+			},
+		}
+
+		// Start the cooldown without sending anything
+		require.Nil(t, client.Flush())
+
+		// Queue more identifiers than the batch size, like concurrent
+		// SetIdentifiers calls can while a batch is being sent.
+		client.queueLock.Lock()
+		for i := 0; i < 5; i++ {
+			client.identifierQueue = append(client.identifierQueue, UserIdentifiers{UserID: "user-" + strconv.Itoa(i)})
+		}
+		client.queueLock.Unlock()
+
+		require.Nil(t, client.Flush())
+
+		wg.Wait()
+
+		require.Equal(t, int32(3), requestCounter.Load())
+		require.Empty(t, client.identifierQueue)
+	})
+}
+
+func TestRound(t *testing.T) {
+	t.Run("single track", func(t *testing.T) {
+		client := NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithFlushCooldown(5 * time.Second).
+			Build()
+		defer client.Close()
+
+		client.transport = nil
+
+		r := client.StartRound("", nil)
+		require.NotEmpty(t, r.id)
+		r.Track("asd", "kill", PointerFrom(1), nil)
+
+		e := &client.eventQueue[0]
+		require.Equal(t, e.UserID, "asd")
+		require.Equal(t, e.Event, "kill")
+		require.Equal(t, *e.Value, 1)
+		require.Equal(t, r.id, e.GroupID)
+	})
+
+	t.Run("single track with custom id", func(t *testing.T) {
+		client := NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithFlushCooldown(5 * time.Second).
+			Build()
+		defer client.Close()
+
+		client.transport = nil
+
+		r := client.StartRound("custom-id", nil)
+		require.Equal(t, "custom-id", r.id)
+		r.Track("asd", "kill", PointerFrom(1), nil)
+
+		e := &client.eventQueue[0]
+		require.Equal(t, e.UserID, "asd")
+		require.Equal(t, e.Event, "kill")
+		require.Equal(t, *e.Value, 1)
+		require.Equal(t, r.id, e.GroupID)
+	})
+
+	t.Run("multiple tracks", func(t *testing.T) {
+		client := NewClientBuilder().
 			WithClientID("a").
 			WithClientSecret("b").
 			WithGameID("c").
@@ -549,7 +2549,7 @@ func TestRound(t *testing.T) {
 			Build()
 		defer client.Close()
 
-		client.httpClient = nil
+		client.transport = nil
 
 		r := client.StartRound("", nil)
 		require.NotEmpty(t, r.id)
@@ -587,7 +2587,7 @@ func TestRound(t *testing.T) {
 			Build()
 		defer client.Close()
 
-		client.httpClient = nil
+		client.transport = nil
 
 		r := client.StartRound("", Traits{"map": "nuclear_wasteland"})
 		require.NotEmpty(t, r.id)
@@ -610,7 +2610,7 @@ func TestRound(t *testing.T) {
 			Build()
 		defer client.Close()
 
-		client.httpClient = nil
+		client.transport = nil
 
 		r := client.StartRound("", Traits{"map": "nuclear_wasteland"})
 		require.NotEmpty(t, r.id)
@@ -624,6 +2624,165 @@ func TestRound(t *testing.T) {
 		require.Equal(t, r.id, e.GroupID)
 		require.Equal(t, e.Traits["map"], "nuclear_utopia")
 	})
+
+	t.Run("track with context", func(t *testing.T) {
+		transport := NewMemoryTransport()
+
+		client := NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithFlushCooldown(5 * time.Second).
+			WithBatchSize(2).
+			WithTransport(transport).
+			Build()
+		defer client.Close()
+
+		r := client.StartRound("", nil)
+
+		require.Nil(t, r.TrackContext(context.Background(), "asd", "kill", PointerFrom(1), nil))
+		require.Empty(t, transport.Payloads())
+
+		// The full batch is sent by the caller
+		require.Nil(t, r.TrackContext(context.Background(), "asd", "kill", PointerFrom(2), nil))
+		require.Len(t, transport.Events(), 2)
+		require.Equal(t, r.id, transport.Events()[0].GroupID)
+
+		// The context is passed to the transport
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		client.transport = &httpTransport{dsn: client.dsn, client: &http.Client{}}
+		require.Nil(t, r.TrackContext(ctx, "asd", "kill", nil, nil))
+		err := r.TrackContext(ctx, "asd", "kill", nil, nil)
+		require.True(t, errors.Is(err, context.Canceled), err)
+	})
+
+	t.Run("flush", func(t *testing.T) {
+		transport := NewMemoryTransport()
+
+		client := NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithFlushCooldown(5 * time.Second).
+			WithBatchSize(10).
+			WithTransport(transport).
+			Build()
+		defer client.Close()
+
+		r := client.StartRound("", nil)
+		r.Track("asd", "kill", nil, nil)
+		client.Track("asd", "kill", nil, nil)
+		client.StartRound("", nil).Track("asd", "kill", nil, nil)
+		r.Track("qwe", "kill", nil, nil)
+
+		require.Nil(t, r.Flush(context.Background()))
+		require.Len(t, transport.Payloads(), 1)
+		events := transport.Events()
+		require.Len(t, events, 2)
+		for _, e := range events {
+			require.Equal(t, r.id, e.GroupID)
+		}
+		require.Len(t, client.eventQueue, 2)
+
+		// Nothing is left to send
+		require.Nil(t, r.Flush(context.Background()))
+		require.Len(t, transport.Payloads(), 1)
+
+		client.Close()
+		require.Equal(t, ErrClientClosed, r.Flush(context.Background()))
+	})
+
+	t.Run("correlation", func(t *testing.T) {
+		transport := NewMemoryTransport()
+
+		client := NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithFlushCooldown(0).
+			WithTransport(transport).
+			Build()
+		defer client.Close()
+
+		r := client.StartRoundWithCorrelation("round", "trace", nil)
+		r.Track("asd", "kill", nil, nil)
+		require.Nil(t, r.TrackContext(context.Background(), "asd", "death", nil, nil))
+		client.StartRound("other", nil).Track("asd", "kill", nil, nil)
+		require.Nil(t, client.Flush())
+
+		events := transport.Events()
+		require.Len(t, events, 3)
+		for _, e := range events[:2] {
+			require.Equal(t, "round", e.GroupID)
+			require.Equal(t, "trace", e.CorrelationID)
+		}
+		require.Empty(t, events[2].CorrelationID)
+
+		require.Contains(t, string(transport.Payloads()[0]), `"groupId":"round","correlationId":"trace"`)
+		require.NotContains(t, string(transport.Payloads()[0]), `"groupId":"other","correlationId"`)
+	})
+
+	t.Run("unique ids", func(t *testing.T) {
+		errChan := make(chan error, 1)
+
+		client := NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithTransport(NewMemoryTransport()).
+			WithErrorChannel(errChan).
+			WithUniqueRoundIDs(true).
+			Build()
+		defer client.Close()
+
+		r := client.StartRound("round-1", nil)
+		client.StartRound("round-2", nil)
+		client.StartRound("", nil)
+		require.Empty(t, errChan)
+
+		// The duplicate round is still returned
+		dup := client.StartRound("round-1", nil)
+		require.NotNil(t, dup)
+		err := <-errChan
+		require.True(t, errors.Is(err, ErrDuplicateRoundID))
+		require.Contains(t, err.Error(), "round-1")
+
+		// Ending the round frees its ID
+		r.End()
+		client.StartRound("round-1", nil)
+		require.Empty(t, errChan)
+	})
+}
+
+func TestRoundContext(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		Build()
+	defer client.Close()
+
+	client.transport = nil
+
+	require.Nil(t, RoundFromContext(context.Background()))
+
+	ctx, r := client.StartRoundContext(context.Background(), "round-id", Traits{"map": "nuclear_wasteland"})
+	require.Equal(t, "round-id", r.id)
+
+	// Child contexts carry the round as well
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	fromCtx := RoundFromContext(ctx)
+	require.True(t, r == fromCtx)
+
+	fromCtx.Track("asd", "kill", nil, Traits{"weapon": "knife"})
+
+	e := &client.eventQueue[0]
+	require.Equal(t, "round-id", e.GroupID)
+	require.Equal(t, Traits{"map": "nuclear_wasteland", "weapon": "knife"}, e.Traits)
 }
 
 func TestSign(t *testing.T) {
@@ -655,6 +2814,117 @@ func TestSign(t *testing.T) {
 
 	// foh123hundred signed with "rah"
 	require.Equal(t, "8462555d220af5dff2922abb6c50dbfe36a87918361dbbdb5572bcf637185d92", s)
+
+	require.Equal(t, "foh123hundred", client.DebugSignedString("123", []byte("hundred")))
+	mac := hmac.New(sha256.New, []byte("rah"))
+	mac.Write([]byte(client.DebugSignedString("123", []byte("hundred"))))
+	require.Equal(t, s, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestMarshaler(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithMarshaler(func(v any) ([]byte, error) {
+			b, err := json.MarshalIndent(v, "", "  ")
+			if err != nil {
+				return nil, err
+			}
+			return b, nil
+		}).
+		Build()
+	defer client.Close()
+
+	requestCounter := 0
+
+	client.transport.(*httpTransport).client = &mockHttpClient{
+		handle: func(req *http.Request) (*http.Response, error) {
+			requestCounter++
+
+			b, err := io.ReadAll(req.Body)
+			require.Nil(t, err)
+			require.Contains(t, string(b), "\n  \"gameId\": \"c\"")
+
+			require.Equal(t, Version(), req.Header.Get("x-sdk-version"))
+
+			// The signature covers the bytes produced by the marshaler
+			signature, err := client.sign(b, req.Header.Get("x-timestamp"))
+			require.Nil(t, err)
+			require.Equal(t, signature, req.Header.Get("x-signature"))
+
+			return &http.Response{
+				Body: io.NopCloser(strings.NewReader(`{"message":"OK"}`)),
+			}, nil
+		},
+	}
+
+	client.Track("asd", "kill", nil, nil)
+
+	require.Nil(t, client.Flush())
+	require.Equal(t, 1, requestCounter)
+
+	client.marshaler = func(v any) ([]byte, error) {
+		return nil, fmt.Errorf("nope")
+	}
+	client.lastFlush = time.Time{}
+	client.Track("asd", "kill", nil, nil)
+
+	err := client.Flush()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to marshal payload: nope")
+}
+
+func TestSignatureEncoding(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithSignatureEncoding(SignatureEncodingBase64).
+		Build()
+	defer client.Close()
+
+	s, err := client.sign([]byte("hello"), "123")
+	require.Nil(t, err)
+
+	// a123hello signed with "b", same vector as in TestSign
+	sum, err := hex.DecodeString("8713437da9757423053fb5beb3e58794321ac22055d5c8fbf0cd0c6b9f5675e5")
+	require.Nil(t, err)
+	require.Equal(t, base64.StdEncoding.EncodeToString(sum), s)
+
+	client.signatureEncoding = SignatureEncodingHex
+
+	s, err = client.sign([]byte("hello"), "123")
+	require.Nil(t, err)
+	require.Equal(t, "8713437da9757423053fb5beb3e58794321ac22055d5c8fbf0cd0c6b9f5675e5", s)
+}
+
+func TestSigner(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithSigner(func(clientID, clientSecret, timestamp string, body []byte) (string, error) {
+			return clientSecret + timestamp + string(body) + clientID, nil
+		}).
+		Build()
+	defer client.Close()
+
+	s, err := client.sign([]byte("hello"), "123")
+	require.Nil(t, err)
+	require.Equal(t, "b123helloa", s)
+
+	client.signer = func(clientID, clientSecret, timestamp string, body []byte) (string, error) {
+		return "", fmt.Errorf("nope")
+	}
+	client.Track("asd", "kill", nil, nil)
+
+	err = client.Flush()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to sign message: nope")
 }
 
 func TestEndToEnd(t *testing.T) {
@@ -910,67 +3180,317 @@ func TestCombineTraits(t *testing.T) {
 			require.Equal(t, tc.expected, combineTraits(tc.a, tc.b))
 		})
 	}
+
+	t.Run("three layers", func(t *testing.T) {
+		require.Equal(t,
+			Traits{"a": "c", "b": "c", "c": "c", "ab": "b"},
+			combineTraits(Traits{"a": "a", "ab": "a", "c": "a"}, Traits{"b": "b", "ab": "b", "c": "b"}, Traits{"a": "c", "b": "c", "c": "c"}),
+		)
+	})
+}
+
+func TestGlobalTraits(t *testing.T) {
+	global := Traits{"layer": "global", "region": "eu", "mode": "ranked", "build": "1"}
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithGlobalTraits(global).
+		Build()
+	defer client.Close()
+
+	client.transport = nil
+
+	// Changing the map afterwards doesn't affect the client
+	global["build"] = "2"
+
+	client.Track("asd", "kill", nil, Traits{"layer": "call", "mode": "casual"})
+	r := client.StartRound("", Traits{"layer": "round", "region": "us", "map": "forest"})
+	r.Track("asd", "kill", nil, Traits{"layer": "call"})
+	r.Track("asd", "kill", nil, nil)
+	client.StartGame("asd")
+
+	require.Equal(t, Traits{"layer": "call", "region": "eu", "mode": "casual", "build": "1"}, client.eventQueue[0].Traits)
+	require.Equal(t, Traits{"layer": "call", "region": "us", "mode": "ranked", "build": "1", "map": "forest"}, client.eventQueue[1].Traits)
+	require.Equal(t, Traits{"layer": "round", "region": "us", "mode": "ranked", "build": "1", "map": "forest"}, client.eventQueue[2].Traits)
+	require.Equal(t, Traits{"layer": "global", "region": "eu", "mode": "ranked", "build": "1"}, client.eventQueue[3].Traits)
+}
+
+func TestTrimTraitStrings(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithGlobalTraits(Traits{"region": " eu\n"}).
+		WithTrimTraitStrings(true).
+		Build()
+	defer client.Close()
+
+	client.transport = nil
+
+	traits := Traits{" map ": " forest ", "kills": 3}
+	client.Track("asd", "kill", nil, traits)
+	r := client.StartRound("", Traits{"mode": "\tranked"})
+	r.Track("asd", "kill", nil, nil)
+
+	require.Equal(t, Traits{"region": "eu", " map ": "forest", "kills": 3}, client.eventQueue[0].Traits)
+	require.Equal(t, Traits{"region": "eu", "mode": "ranked"}, client.eventQueue[1].Traits)
+	// The traits passed by the caller aren't changed
+	require.Equal(t, Traits{" map ": " forest ", "kills": 3}, traits)
+}
+
+func TestIdentifiersJSON(t *testing.T) {
+	testCases := []struct {
+		name     string
+		i        *Identifiers
+		expected string
+	}{
+		{
+			name:     "empty",
+			i:        &Identifiers{},
+			expected: "{}",
+		},
+		{
+			name: "apple id nil",
+			i: &Identifiers{
+				AppleID: nil,
+			},
+			expected: "{}",
+		},
+		{
+			name: "apple id empty string",
+			i: &Identifiers{
+				AppleID: IdentifierFrom(""),
+			},
+			expected: `{"appleId":null}`,
+		},
+		{
+			name: "apple id normal string",
+			i: &Identifiers{
+				AppleID: IdentifierFrom("normal"),
+			},
+			expected: `{"appleId":"normal"}`,
+		},
+		{
+			name: "apple and twitter id empty string",
+			i: &Identifiers{
+				AppleID:   IdentifierFrom(""),
+				TwitterId: IdentifierFrom(""),
+			},
+			expected: `{"appleId":null,"twitterId":null}`,
+		},
+		{
+			name: "apple and twitter id normal strings",
+			i: &Identifiers{
+				AppleID:   IdentifierFrom("a"),
+				TwitterId: IdentifierFrom("b"),
+			},
+			expected: `{"appleId":"a","twitterId":"b"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := json.Marshal(tc.i)
+			require.Nil(t, err)
+			require.Equal(t, tc.expected, string(s))
+		})
+	}
+}
+
+func TestHTTPTransport(t *testing.T) {
+	testCases := []struct {
+		name        string
+		statusCode  int
+		body        string
+		expectedErr string
+	}{
+		{
+			name:       "ok",
+			statusCode: http.StatusOK,
+			body:       `{"message":"OK"}`,
+		},
+		{
+			name:        "error message",
+			statusCode:  http.StatusBadRequest,
+			body:        `{"error":"bad"}`,
+			expectedErr: "server returned error: bad",
+		},
+		{
+			name:        "server error",
+			statusCode:  http.StatusBadGateway,
+			expectedErr: "server returned server error: 502",
+		},
+		{
+			name:        "unexpected response",
+			statusCode:  http.StatusOK,
+			body:        `{"foo":"bar"}`,
+			expectedErr: "unexpected response from server",
+		},
+		{
+			name:        "invalid body",
+			statusCode:  http.StatusOK,
+			body:        `nope`,
+			expectedErr: "failed to decode response body",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			transport := &httpTransport{
+				dsn: "https://example.com/events",
+				client: &mockHttpClient{
+					handle: func(req *http.Request) (*http.Response, error) {
+						require.Equal(t, "https://example.com/events", req.URL.String())
+						require.Equal(t, "application/json", req.Header.Get("Content-Type"))
+						require.Equal(t, "sig", req.Header.Get("x-signature"))
+
+						b, err := io.ReadAll(req.Body)
+						require.Nil(t, err)
+						require.Equal(t, `{"a":1}`, string(b))
+
+						return &http.Response{
+							StatusCode: tc.statusCode,
+							Body:       io.NopCloser(strings.NewReader(tc.body)),
+						}, nil
+					},
+				},
+			}
+
+			err := transport.Send(context.Background(), []byte(`{"a":1}`), map[string]string{"x-signature": "sig"})
+			if tc.expectedErr == "" {
+				require.Nil(t, err)
+			} else {
+				require.NotNil(t, err)
+				require.Contains(t, err.Error(), tc.expectedErr)
+			}
+		})
+	}
+}
+
+func TestHTTPTransportGzip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		fmt.Fprint(gw, `{"error":"bad"}`)
+		require.Nil(t, gw.Close())
+	}))
+	defer server.Close()
+
+	transport := &httpTransport{dsn: server.URL, client: &http.Client{}}
+
+	err := transport.Send(context.Background(), []byte(`{"a":1}`), nil)
+	require.NotNil(t, err)
+	require.Equal(t, "server returned error: bad", err.Error())
 }
 
-func TestIdentifiersJSON(t *testing.T) {
+func TestHTTPTransportStrict(t *testing.T) {
 	testCases := []struct {
-		name     string
-		i        *Identifiers
-		expected string
+		name        string
+		statusCode  int
+		body        string
+		expectedErr *APIError
 	}{
 		{
-			name:     "empty",
-			i:        &Identifiers{},
-			expected: "{}",
-		},
-		{
-			name: "apple id nil",
-			i: &Identifiers{
-				AppleID: nil,
-			},
-			expected: "{}",
+			name:       "ok",
+			statusCode: http.StatusOK,
+			body:       `{"message":"OK","received":3}`,
 		},
 		{
-			name: "apple id empty string",
-			i: &Identifiers{
-				AppleID: IdentifierFrom(""),
-			},
-			expected: `{"appleId":null}`,
+			name:        "ok with client error status",
+			statusCode:  http.StatusBadRequest,
+			body:        `{"message":"OK"}`,
+			expectedErr: &APIError{StatusCode: http.StatusBadRequest, Body: []byte(`{"message":"OK"}`)},
 		},
 		{
-			name: "apple id normal string",
-			i: &Identifiers{
-				AppleID: IdentifierFrom("normal"),
-			},
-			expected: `{"appleId":"normal"}`,
+			name:        "error message",
+			statusCode:  http.StatusOK,
+			body:        `{"message":"OK","error":"bad"}`,
+			expectedErr: &APIError{StatusCode: http.StatusOK, Message: "bad", Body: []byte(`{"message":"OK","error":"bad"}`)},
 		},
 		{
-			name: "apple and twitter id empty string",
-			i: &Identifiers{
-				AppleID:   IdentifierFrom(""),
-				TwitterId: IdentifierFrom(""),
-			},
-			expected: `{"appleId":null,"twitterId":null}`,
+			name:        "server error",
+			statusCode:  http.StatusBadGateway,
+			body:        `<html></html>`,
+			expectedErr: &APIError{StatusCode: http.StatusBadGateway, Body: []byte(`<html></html>`)},
 		},
 		{
-			name: "apple and twitter id normal strings",
-			i: &Identifiers{
-				AppleID:   IdentifierFrom("a"),
-				TwitterId: IdentifierFrom("b"),
-			},
-			expected: `{"appleId":"a","twitterId":"b"}`,
+			name:        "missing message",
+			statusCode:  http.StatusOK,
+			body:        `{}`,
+			expectedErr: &APIError{StatusCode: http.StatusOK, Body: []byte(`{}`)},
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			s, err := json.Marshal(tc.i)
-			require.Nil(t, err)
-			require.Equal(t, tc.expected, string(s))
+			transport := &httpTransport{
+				dsn:    "https://example.com/events",
+				strict: true,
+				client: &mockHttpClient{
+					handle: func(req *http.Request) (*http.Response, error) {
+						return &http.Response{
+							StatusCode: tc.statusCode,
+							Body:       io.NopCloser(strings.NewReader(tc.body)),
+						}, nil
+					},
+				},
+			}
+
+			err := transport.Send(context.Background(), []byte(`{"a":1}`), nil)
+			if tc.expectedErr == nil {
+				require.Nil(t, err)
+				return
+			}
+
+			var apiErr *APIError
+			require.True(t, errors.As(err, &apiErr), err)
+			require.Equal(t, tc.expectedErr, apiErr)
 		})
 	}
 }
 
+func TestHTTPTransportResponseParser(t *testing.T) {
+	var status int
+	var body string
+	parser := func(status int, body []byte) error {
+		if status == http.StatusNoContent || string(body) == `{"success":true}` {
+			return nil
+		}
+		return fmt.Errorf("failed with %d: %s", status, body)
+	}
+
+	transport := &httpTransport{
+		dsn:    "https://example.com/events",
+		parser: parser,
+		client: &mockHttpClient{
+			handle: func(req *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: status,
+					Body:       io.NopCloser(strings.NewReader(body)),
+				}, nil
+			},
+		},
+	}
+
+	status, body = http.StatusOK, `{"success":true}`
+	require.Nil(t, transport.Send(context.Background(), []byte(`{"a":1}`), nil))
+
+	status, body = http.StatusNoContent, ""
+	require.Nil(t, transport.Send(context.Background(), []byte(`{"a":1}`), nil))
+
+	// The default success message isn't a success anymore
+	status, body = http.StatusOK, `{"message":"OK"}`
+	err := transport.Send(context.Background(), []byte(`{"a":1}`), nil)
+	require.NotNil(t, err)
+	require.Equal(t, `failed with 200: {"message":"OK"}`, err.Error())
+}
+
 type mockHttpClient struct {
 	handle func(req *http.Request) (*http.Response, error)
 }
@@ -1000,7 +3520,7 @@ func TestFlushMechanisms(t *testing.T) {
 
 	requestCounter := 0
 
-	client.httpClient = &mockHttpClient{
+	client.transport.(*httpTransport).client = &mockHttpClient{
 		handle: func(req *http.Request) (*http.Response, error) {
 			defer wg.Done()
 
@@ -1076,3 +3596,589 @@ func TestFlushMechanisms(t *testing.T) {
 	require.Len(t, client.eventQueue, 0)
 	require.Len(t, client.identifierQueue, 0)
 }
+
+func benchmarkEvents(n int) []Event {
+	events := make([]Event, 0, n)
+	for i := 0; i < n; i++ {
+		events = append(events, Event{
+			UserID:  "user-" + strconv.Itoa(i),
+			Time:    time.Now().Format(time.RFC3339),
+			Event:   "KILL",
+			GroupID: "round",
+			Traits:  Traits{"weapon": "knife", "mob": "zombie"},
+			Value:   PointerFrom(i),
+		})
+	}
+	return events
+}
+
+func TestEncodePayload(t *testing.T) {
+	p := &payload{
+		GameID:      "c",
+		Events:      benchmarkEvents(2),
+		Identifiers: []UserIdentifiers{{UserID: "asd", Identifiers: Identifiers{DiscordID: IdentifierFrom("yope")}}},
+	}
+
+	expected, err := json.Marshal(p)
+	require.Nil(t, err)
+
+	var buf bytes.Buffer
+	b, err := encodePayload(&buf, p)
+	require.Nil(t, err)
+	require.Equal(t, string(expected), string(b))
+}
+
+func TestEncodePayloadIsStable(t *testing.T) {
+	p := &payload{
+		GameID: "c",
+		Events: []Event{{
+			UserID:  "asd",
+			Time:    "2024-01-02T03:04:05Z",
+			Event:   "KILL",
+			GroupID: "round",
+			Traits:  Traits{"weapon": "knife", "mob": "zombie", "area": Traits{"z": 1, "a": 2}},
+			Value:   PointerFrom(3),
+		}},
+		Identifiers: []UserIdentifiers{{UserID: "asd", Identifiers: Identifiers{SteamID: IdentifierFrom("s"), AppleID: RemoveIdentifier()}}},
+	}
+
+	expected := `{"gameId":"c",` +
+		`"events":[{"userId":"asd","time":"2024-01-02T03:04:05Z","event":"KILL","groupId":"round",` +
+		`"traits":{"area":{"a":2,"z":1},"mob":"zombie","weapon":"knife"},"value":3}],` +
+		`"identifiers":[{"userId":"asd","appleId":null,"steamId":"s"}]}`
+
+	for i := 0; i < 10; i++ {
+		var buf bytes.Buffer
+		b, err := encodePayload(&buf, p)
+		require.Nil(t, err)
+		require.Equal(t, expected, string(b))
+	}
+}
+
+func TestValueFormatter(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithValueFormatter(func(value *int) any {
+			if value == nil {
+				return nil
+			}
+			return strconv.Itoa(*value * 100)
+		}).
+		Build()
+	defer client.Close()
+
+	client.transport = nil
+
+	p := &payload{
+		GameID: "c",
+		Events: []Event{
+			{UserID: "asd", Time: "2024-01-02T03:04:05Z", Event: "BUY", Value: PointerFrom(3)},
+			{UserID: "asd", Time: "2024-01-02T03:04:05Z", Event: "KILL"},
+		},
+		Identifiers: []UserIdentifiers{},
+	}
+
+	expected := `{"gameId":"c",` +
+		`"events":[{"userId":"asd","time":"2024-01-02T03:04:05Z","event":"BUY","groupId":"","value":"300"},` +
+		`{"userId":"asd","time":"2024-01-02T03:04:05Z","event":"KILL","groupId":""}],` +
+		`"identifiers":[]}`
+
+	var buf bytes.Buffer
+	b, err := client.marshalPayload(&buf, p)
+	require.Nil(t, err)
+	require.Equal(t, expected, string(b))
+
+	// The events keep their values
+	require.Equal(t, 3, *p.Events[0].Value)
+}
+
+func TestOmitEmptyArrays(t *testing.T) {
+	events := []Event{{UserID: "asd", Time: "2024-01-02T03:04:05Z", Event: "KILL"}}
+	identifiers := []UserIdentifiers{{UserID: "asd"}}
+	formatter := func(value *int) any { return "formatted" }
+
+	tests := []struct {
+		name        string
+		omit        bool
+		formatter   func(value *int) any
+		events      []Event
+		identifiers []UserIdentifiers
+		expected    string
+	}{
+		{
+			name:     "nil arrays are present",
+			expected: `{"gameId":"c","events":[],"identifiers":[]}`,
+		},
+		{
+			name:     "empty identifiers omitted",
+			omit:     true,
+			events:   events,
+			expected: `{"gameId":"c","events":[{"userId":"asd","time":"2024-01-02T03:04:05Z","event":"KILL","groupId":""}]}`,
+		},
+		{
+			name:        "empty events omitted",
+			omit:        true,
+			events:      []Event{},
+			identifiers: identifiers,
+			expected:    `{"gameId":"c","identifiers":[{"userId":"asd"}]}`,
+		},
+		{
+			name:      "formatted events",
+			omit:      true,
+			formatter: formatter,
+			events:    events,
+			expected:  `{"gameId":"c","events":[{"userId":"asd","time":"2024-01-02T03:04:05Z","event":"KILL","groupId":"","value":"formatted"}]}`,
+		},
+		{
+			name:      "formatted empty events omitted",
+			omit:      true,
+			formatter: formatter,
+			expected:  `{"gameId":"c"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewClientBuilder().
+				WithClientID("a").
+				WithClientSecret("b").
+				WithGameID("c").
+				WithTransport(NewMemoryTransport()).
+				WithOmitEmptyArrays(tt.omit).
+				WithValueFormatter(tt.formatter).
+				Build()
+			defer client.Close()
+
+			var buf bytes.Buffer
+			b, err := client.marshalPayload(&buf, &payload{GameID: "c", Events: tt.events, Identifiers: tt.identifiers})
+			require.Nil(t, err)
+			require.Equal(t, tt.expected, string(b))
+		})
+	}
+}
+
+func TestUnmarshalableEvent(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(5 * time.Second).
+		WithBatchSize(10).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	client.Track("user", "kill", PointerFrom(1), nil)
+	client.Track("user", "poison", nil, Traits{"callback": func() {}})
+	client.Track("user", "kill", PointerFrom(2), nil)
+
+	err := client.Flush()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), `dropped event "poison" for user "user"`)
+
+	// The healthy events are still sent
+	events := transport.Events()
+	require.Len(t, events, 2)
+	for _, e := range events {
+		require.Equal(t, "kill", e.Event)
+	}
+	require.Empty(t, client.eventQueue)
+
+	t.Run("only unmarshalable events", func(t *testing.T) {
+		transport.Reset()
+		client.SetIdentifiers("user", NewIdentifiers().Discord("d").Build())
+		client.Track("user", "poison", nil, Traits{"ratio": math.NaN()})
+		dropped := client.Stats().Dropped
+
+		err := client.ForceFlush(context.Background())
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), `dropped event "poison" for user "user"`)
+
+		// The identifier update of the batch is still sent
+		require.Empty(t, transport.Events())
+		require.Len(t, transport.Identifiers(), 1)
+		require.Equal(t, dropped+1, client.Stats().Dropped)
+		require.Empty(t, client.identifierQueue)
+	})
+}
+
+func TestOnDrop(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	type drop struct {
+		reason      DropReason
+		events      []Event
+		identifiers []UserIdentifiers
+	}
+	var drops []drop
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithBatchSize(10).
+		WithTransport(transport).
+		WithOnDrop(func(reason DropReason, events []Event, identifiers []UserIdentifiers) {
+			drops = append(drops, drop{reason, events, identifiers})
+		}).
+		Build()
+	defer client.Close()
+
+	client.Track("user", "kill", nil, nil)
+	client.Track("user", "poison", nil, Traits{"callback": func() {}})
+
+	// The dropped event isn't reported as an error
+	require.Nil(t, client.Flush())
+	require.Len(t, transport.Events(), 1)
+	require.Len(t, drops, 1)
+	require.Equal(t, DropReasonUnmarshalable, drops[0].reason)
+	require.Len(t, drops[0].events, 1)
+	require.Equal(t, "poison", drops[0].events[0].Event)
+
+	client.Track("deleted", "kill", nil, nil)
+	client.appendIdentifier(&UserIdentifiers{UserID: "deleted"})
+	client.PurgeUser("deleted")
+
+	require.Len(t, drops, 2)
+	require.Equal(t, DropReasonPurged, drops[1].reason)
+	require.Len(t, drops[1].events, 1)
+	require.Len(t, drops[1].identifiers, 1)
+
+	// Nothing is dropped, so the callback isn't called
+	client.PurgeUser("deleted")
+	events, identifiers := client.PurgeQueue()
+	require.Zero(t, events)
+	require.Zero(t, identifiers)
+	require.Len(t, drops, 2)
+}
+
+func TestIdentifierMaxAge(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	var expired []UserIdentifiers
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithBatchSize(10).
+		WithTransport(transport).
+		WithIdentifierMaxAge(time.Minute).
+		WithOnDrop(func(reason DropReason, events []Event, identifiers []UserIdentifiers) {
+			require.Equal(t, DropReasonExpired, reason)
+			expired = append(expired, identifiers...)
+		}).
+		Build()
+	defer client.Close()
+
+	client.appendIdentifier(&UserIdentifiers{UserID: "stale"})
+	client.appendIdentifier(&UserIdentifiers{UserID: "fresh"})
+	client.identifierQueue[0].queuedAt = time.Now().Add(-time.Hour)
+
+	require.Nil(t, client.Flush())
+	require.Len(t, expired, 1)
+	require.Equal(t, "stale", expired[0].UserID)
+	require.Len(t, transport.Identifiers(), 1)
+	require.Equal(t, "fresh", transport.Identifiers()[0].UserID)
+
+	require.PanicsWithValue(t, "identifier max age must be at least 0", func() {
+		NewClientBuilder().WithIdentifierMaxAge(-1)
+	})
+}
+
+// BenchmarkMarshalMapPayload measures the previous approach of
+// marshalling a map, for comparison with BenchmarkEncodePayload.
+func BenchmarkMarshalMapPayload(b *testing.B) {
+	events := benchmarkEvents(100)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m := map[string]any{
+			"gameId":      "c",
+			"events":      events,
+			"identifiers": []UserIdentifiers{},
+		}
+		if _, err := json.Marshal(&m); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodePayload(b *testing.B) {
+	events := benchmarkEvents(100)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		buf := bufferPool.Get().(*bytes.Buffer)
+		if _, err := encodePayload(buf, &payload{
+			GameID:      "c",
+			Events:      events,
+			Identifiers: []UserIdentifiers{},
+		}); err != nil {
+			b.Fatal(err)
+		}
+		putBuffer(buf)
+	}
+}
+
+func TestStrictIdentifiers(t *testing.T) {
+	transport := NewMemoryTransport()
+	errChan := make(chan error, 1)
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithTransport(transport).
+		WithFlushOnIdentifier(false).
+		WithErrorChannel(errChan).
+		WithStrictIdentifiers(true).
+		Build()
+	defer client.Close()
+
+	// An identifier that is empty by accident is rejected
+	client.SetIdentifiers("asd", NewIdentifiers().Discord("").Steam("s").Build())
+	err := <-errChan
+	require.True(t, errors.Is(err, ErrEmptyIdentifier))
+	require.Contains(t, err.Error(), "discordId")
+	require.Empty(t, client.identifierQueue)
+
+	// Explicit removals are kept
+	client.SetIdentifiers("asd", NewIdentifiers().Remove(DiscordID).Steam("s").Build())
+	client.SetIdentifiers("qwe", &Identifiers{Email: RemoveIdentifier()})
+	require.Nil(t, client.Flush())
+
+	require.Equal(t, `{"gameId":"c","events":[],"identifiers":[`+
+		`{"userId":"asd","discordId":null,"steamId":"s"},{"userId":"qwe","email":null}]}`, string(transport.Payloads()[0]))
+
+	// Removals are empty identifiers, and changing one doesn't change the other removals
+	removal := RemoveIdentifier()
+	require.Equal(t, Identifier(""), *removal)
+	*removal = "x"
+	client.SetIdentifiers("asd", &Identifiers{Email: RemoveIdentifier()})
+	require.Nil(t, client.Flush())
+	require.Equal(t, `{"gameId":"c","events":[],"identifiers":[{"userId":"asd","email":null}]}`, string(transport.Payloads()[1]))
+}
+
+func TestPayloadSizeWarning(t *testing.T) {
+	transport := NewMemoryTransport()
+	var sizes []int
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithTransport(transport).
+		WithPayloadSizeWarning(200, func(size int) {
+			sizes = append(sizes, size)
+		}).
+		Build()
+	defer client.Close()
+
+	client.Track("asd", "kill", nil, nil)
+	require.Nil(t, client.Flush())
+	require.Empty(t, sizes)
+
+	client.Track("asd", "kill", nil, Traits{"weapon": strings.Repeat("a", 200)})
+	require.Nil(t, client.Flush())
+
+	// The payload is still sent
+	require.Len(t, transport.Payloads(), 2)
+	require.Equal(t, []int{len(transport.Payloads()[1])}, sizes)
+
+	require.Panics(t, func() { NewClientBuilder().WithPayloadSizeWarning(0, func(int) {}) })
+	require.Panics(t, func() { NewClientBuilder().WithPayloadSizeWarning(1, nil) })
+}
+
+func TestIdentifierValidator(t *testing.T) {
+	steamID := func(value string) error {
+		if len(value) != 17 {
+			return errors.New("must have 17 digits")
+		}
+		return nil
+	}
+
+	newClient := func(reject bool) (*Client, *MemoryTransport, chan error) {
+		transport := NewMemoryTransport()
+		errChan := make(chan error, 2)
+		client := NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithFlushCooldown(0).
+			WithFlushOnIdentifier(false).
+			WithTransport(transport).
+			WithErrorChannel(errChan).
+			WithIdentifierValidator(SteamID, steamID).
+			WithRejectInvalidIdentifiers(reject).
+			Build()
+		return client, transport, errChan
+	}
+
+	t.Run("field", func(t *testing.T) {
+		client, transport, errChan := newClient(false)
+		defer client.Close()
+
+		is := NewIdentifiers().Steam("123").Discord("d").Build()
+		client.SetIdentifiers("asd", is)
+		require.Equal(t, `invalid identifiers of user "asd": steamId: must have 17 digits`, (<-errChan).Error())
+		// The passed identifiers are kept
+		require.Equal(t, IdentifierFrom("123"), is.SteamID)
+
+		// An update without valid fields isn't queued, removals aren't validated
+		client.SetIdentifiers("asd", NewIdentifiers().Steam("123").Build())
+		require.NotNil(t, <-errChan)
+		client.SetIdentifiers("asd", NewIdentifiers().Steam("76561197960287930").Build())
+		client.SetIdentifiers("asd", NewIdentifiers().Remove(SteamID).Build())
+		require.Nil(t, client.Flush())
+
+		require.Equal(t, `{"gameId":"c","events":[],"identifiers":[`+
+			`{"userId":"asd","discordId":"d"},{"userId":"asd","steamId":"76561197960287930"},`+
+			`{"userId":"asd","steamId":null}]}`, string(transport.Payloads()[0]))
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		client, _, errChan := newClient(true)
+		defer client.Close()
+
+		client.SetIdentifiers("asd", NewIdentifiers().Steam("123").Discord("d").Build())
+		require.NotNil(t, <-errChan)
+		require.Empty(t, client.identifierQueue)
+	})
+
+	require.PanicsWithValue(t, "unknown identifier field: nope", func() {
+		NewClientBuilder().WithIdentifierValidator("nope", steamID)
+	})
+}
+
+func TestOnFlush(t *testing.T) {
+	transport := NewMemoryTransport()
+	triggers := make(chan FlushTrigger, 10)
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithFlushInterval(50 * time.Millisecond).
+		WithBatchSize(2).
+		WithAsyncBatchFlush(false).
+		WithTransport(transport).
+		WithOnFlush(func(trigger FlushTrigger, err error) {
+			require.Nil(t, err)
+			triggers <- trigger
+		}).
+		Build()
+	defer client.Close()
+
+	client.Track("asd", "kill", nil, nil)
+	require.Nil(t, client.Flush())
+	require.Equal(t, FlushTriggerExplicit, <-triggers)
+
+	client.Track("asd", "kill", nil, nil)
+	client.Track("asd", "kill", nil, nil)
+	require.Equal(t, FlushTriggerBatchSize, <-triggers)
+
+	client.SetIdentifiers("asd", NewIdentifiers().Discord("d").Build())
+	require.Equal(t, FlushTriggerIdentifier, <-triggers)
+
+	require.Equal(t, FlushTriggerInterval, <-triggers)
+
+	require.Equal(t, "batch size", FlushTriggerBatchSize.String())
+	require.Equal(t, "FlushTrigger(9)", FlushTrigger(9).String())
+}
+
+func TestPendingForUser(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushOnIdentifier(false).
+		WithTransport(NewMemoryTransport()).
+		Build()
+	defer client.Close()
+
+	client.Track("asd", "kill", PointerFrom(1), Traits{"weapon": "sword"})
+	client.Track("qwe", "kill", nil, nil)
+	client.TrackMetrics("asd", "hit", map[string]float64{"damage": 5}, nil)
+	client.SetIdentifiers("asd", NewIdentifiers().Discord("d").Remove(SteamID).Build())
+	client.SetIdentifiers("qwe", NewIdentifiers().Discord("q").Build())
+
+	events, identifiers := client.PendingForUser("asd")
+	require.Len(t, events, 2)
+	require.Equal(t, "kill", events[0].Event)
+	require.Equal(t, "hit", events[1].Event)
+	require.Len(t, identifiers, 1)
+	require.Equal(t, IdentifierFrom("d"), identifiers[0].DiscordID)
+	require.Equal(t, RemoveIdentifier(), identifiers[0].SteamID)
+
+	// Changing the copies doesn't change the queue
+	*events[0].Value = 2
+	events[0].Traits["weapon"] = "axe"
+	events[1].Metrics["damage"] = 6
+	*identifiers[0].DiscordID = "x"
+	require.Equal(t, 1, *client.eventQueue[0].Value)
+	require.Equal(t, "sword", client.eventQueue[0].Traits["weapon"])
+	require.Equal(t, 5.0, client.eventQueue[2].Metrics["damage"])
+	require.Equal(t, IdentifierFrom("d"), client.identifierQueue[0].DiscordID)
+	require.Equal(t, 5, client.queueSize())
+
+	events, identifiers = client.PendingForUser("zxc")
+	require.Empty(t, events)
+	require.Empty(t, identifiers)
+}
+
+func TestPayloadEncodingNDJSON(t *testing.T) {
+	transport := &headerTransport{MemoryTransport: NewMemoryTransport()}
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithFlushOnIdentifier(false).
+		WithTimeFunc(func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) }).
+		WithTransport(transport).
+		WithPayloadEncoding(PayloadEncodingNDJSON).
+		Build()
+	defer client.Close()
+
+	client.Track("asd", "kill", PointerFrom(3), nil)
+	client.SetIdentifiers("asd", NewIdentifiers().Discord("d").Build())
+	client.Track("qwe", "death", nil, nil)
+	require.Nil(t, client.Flush())
+
+	payload := transport.Payloads()[0]
+	require.Equal(t, `{"gameId":"c","event":{"userId":"asd","time":"2024-01-02T03:04:05Z","event":"kill","groupId":"","value":3}}`+"\n"+
+		`{"gameId":"c","event":{"userId":"qwe","time":"2024-01-02T03:04:05Z","event":"death","groupId":""}}`+"\n"+
+		`{"gameId":"c","identifiers":{"userId":"asd","discordId":"d"}}`+"\n", string(payload))
+	require.Equal(t, ndjsonContentType, transport.headers["Content-Type"])
+
+	// The signature covers the NDJSON bytes
+	signature, err := client.sign(payload, transport.headers["x-timestamp"])
+	require.Nil(t, err)
+	require.Equal(t, signature, transport.headers["x-signature"])
+
+	// The lines of a custom marshaler are compacted
+	client.marshaler = func(v any) ([]byte, error) {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	client.Track("asd", "kill", nil, nil)
+	require.Nil(t, client.Flush())
+	require.Equal(t, `{"gameId":"c","event":{"userId":"asd","time":"2024-01-02T03:04:05Z","event":"kill","groupId":""}}`+"\n",
+		string(transport.Payloads()[1]))
+
+	require.PanicsWithValue(t, "unknown payload encoding", func() {
+		NewClientBuilder().WithPayloadEncoding(PayloadEncoding(5))
+	})
+}
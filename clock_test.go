@@ -0,0 +1,219 @@
+package earnalliance
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a Clock whose time only moves with Advance.
+// The functions of its timers are called by Advance.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	at    time.Time
+	f     func()
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the time forward by d and fires the timers that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	c.timers = pending
+	c.lock.Unlock()
+
+	for _, t := range due {
+		t.f()
+	}
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	for i, pending := range t.clock.timers {
+		if pending == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func TestFlushCooldownClock(t *testing.T) {
+	transport := NewMemoryTransport()
+	clock := newFakeClock()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(10 * time.Second).
+		WithFlushInterval(0).
+		WithClock(clock).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	flush := func(expected FlushOutcome) {
+		t.Helper()
+		outcome, err := client.FlushWithOutcome()
+		require.Nil(t, err)
+		require.Equal(t, expected, outcome)
+	}
+
+	// Send now
+	client.Track("asd", "kill", nil, nil)
+	flush(FlushOutcomeSent)
+	require.Len(t, transport.Payloads(), 1)
+
+	// Schedule a waiter, then do nothing while it waits
+	client.Track("asd", "kill", nil, nil)
+	flush(FlushOutcomeScheduled)
+	flush(FlushOutcomeSkipped)
+
+	clock.Advance(9 * time.Second)
+	require.Len(t, transport.Payloads(), 1)
+
+	clock.Advance(time.Second)
+	require.Len(t, transport.Payloads(), 2)
+	require.Nil(t, client.flushWaiting)
+
+	// The waiter started a new cooldown
+	client.Track("asd", "kill", nil, nil)
+	flush(FlushOutcomeScheduled)
+	clock.Advance(10 * time.Second)
+	require.Len(t, transport.Payloads(), 3)
+
+	// Once the cooldown is over, the next flush is sent right away
+	clock.Advance(10 * time.Second)
+	client.Track("asd", "kill", nil, nil)
+	flush(FlushOutcomeSent)
+	require.Len(t, transport.Payloads(), 4)
+
+	require.PanicsWithValue(t, "clock cannot be nil", func() {
+		NewClientBuilder().WithClock(nil)
+	})
+}
+
+func TestMinFlushBatch(t *testing.T) {
+	transport := NewMemoryTransport()
+	clock := newFakeClock()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(10 * time.Second).
+		WithFlushInterval(0).
+		WithMinFlushBatch(3).
+		WithClock(clock).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	flush := func(expected FlushOutcome) {
+		t.Helper()
+		outcome, err := client.FlushWithOutcome()
+		require.Nil(t, err)
+		require.Equal(t, expected, outcome)
+	}
+
+	// A single event after the cooldown waits for another one
+	client.Track("asd", "kill", nil, nil)
+	flush(FlushOutcomeScheduled)
+	clock.Advance(9 * time.Second)
+	require.Empty(t, transport.Payloads())
+
+	// It is sent by the waiter regardless of how many items are queued
+	clock.Advance(time.Second)
+	require.Len(t, transport.Payloads(), 1)
+
+	// A full enough queue is sent right away once the cooldown is over,
+	// which cancels the waiter
+	clock.Advance(10 * time.Second)
+	client.Track("asd", "kill", nil, nil)
+	flush(FlushOutcomeScheduled)
+	client.Track("asd", "kill", nil, nil)
+	client.Track("asd", "kill", nil, nil)
+	flush(FlushOutcomeSent)
+	require.Len(t, transport.Payloads(), 2)
+	require.Nil(t, client.flushWaiting)
+
+	require.PanicsWithValue(t, "min flush batch must be at least 0", func() {
+		NewClientBuilder().WithMinFlushBatch(-1)
+	})
+}
+
+func TestStartGameSession(t *testing.T) {
+	clock := newFakeClock()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithTransport(NewMemoryTransport()).
+		WithClock(clock).
+		WithStartGameSessionTimeout(time.Hour).
+		Build()
+	defer client.Close()
+
+	client.StartGameSession("asd", "phone")
+	client.StartGameSession("asd", "phone")
+	// Concurrent sessions of the user are started separately
+	client.StartGameSession("asd", "desktop")
+	require.Len(t, client.eventQueue, 2)
+	require.Equal(t, StartGameEvent, client.eventQueue[0].Event)
+	require.Equal(t, Traits{StartGameSessionTrait: "phone"}, client.eventQueue[0].Traits)
+	require.Equal(t, Traits{StartGameSessionTrait: "desktop"}, client.eventQueue[1].Traits)
+
+	// The session is started again after the timeout
+	clock.Advance(time.Hour)
+	client.StartGameSession("asd", "phone")
+	require.Len(t, client.eventQueue, 3)
+
+	// Or once it was ended
+	client.EndGameSession("asd", "desktop")
+	client.StartGameSession("asd", "desktop")
+	client.StartGameSession("asd", "desktop")
+	require.Len(t, client.eventQueue, 4)
+
+	require.PanicsWithValue(t, "start game session timeout must be positive", func() {
+		NewClientBuilder().WithStartGameSessionTimeout(0)
+	})
+}
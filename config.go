@@ -0,0 +1,89 @@
+package earnalliance
+
+import (
+	"maps"
+	"net/url"
+	"time"
+)
+
+// redacted replaces secrets in a ClientConfig, like url.URL.Redacted does for passwords.
+const redacted = "xxxxx"
+
+// ClientConfig is a snapshot of the effective configuration of a client,
+// including the values that were read from the environment variables.
+type ClientConfig struct {
+	// Name is empty if the client is unnamed
+	Name     string
+	GameID   string
+	ClientID string
+	// ClientSecret is always redacted
+	ClientSecret string
+	// DSN is redacted if it contains a password
+	DSN                   string
+	BatchSize             int
+	FlushInterval         time.Duration
+	FlushCooldown         time.Duration
+	MaxRetryAttempts      int
+	RetryWaitMin          time.Duration
+	RetryWaitMax          time.Duration
+	RetryJitter           bool
+	ResponseHeaderTimeout time.Duration
+}
+
+// Config returns a snapshot of the effective configuration of the client,
+// e.g. to confirm what a running client is configured with.
+// It reflects the changes made by SetBatchSize and SetFlushInterval.
+func (c *Client) Config() ClientConfig {
+	c.queueLock.Lock()
+	batchSize, flushInterval := c.batchSize, c.flushInterval
+	c.queueLock.Unlock()
+
+	return ClientConfig{
+		Name:                  c.name,
+		GameID:                c.gameID,
+		ClientID:              c.clientID,
+		ClientSecret:          redacted,
+		DSN:                   redactDSN(c.dsn),
+		BatchSize:             batchSize,
+		FlushInterval:         flushInterval,
+		FlushCooldown:         c.flushCooldown,
+		MaxRetryAttempts:      c.maxRetryAttempts,
+		RetryWaitMin:          c.retryWaitMin,
+		RetryWaitMax:          c.retryWaitMax,
+		RetryJitter:           c.retryJitter,
+		ResponseHeaderTimeout: c.responseHeaderTimeout,
+	}
+}
+
+func redactDSN(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return redacted
+	}
+	return u.Redacted()
+}
+
+// Clone returns a builder with the configuration of the client, to build another client
+// that only differs by a few options, e.g. client.Clone().WithGameID("other").Build().
+// The new client is independent, with its own queue and batch handler goroutine.
+// The queue set via WithQueue and the spool file set via WithOfflineSpool aren't shared either,
+// the new client keeps its items in memory and doesn't spool them, unless they are set on the builder.
+// The error channel, the callbacks and a custom transport are shared between them.
+func (c *Client) Clone() *ClientBuilder {
+	c.queueLock.Lock()
+	o := c.options
+	c.queueLock.Unlock()
+
+	o.globalTraits = combineTraits(o.globalTraits)
+	o.identifierValidators = maps.Clone(o.identifierValidators)
+	// Sharing the queue would send the items of one client with the configuration of the other
+	o.queue = nil
+	// The spool file is rewritten by ReplaySpool under a lock of the client
+	o.spoolPath = ""
+	// The default transport is created by Build, for the DSN of the new client
+	if _, ok := o.transport.(*httpTransport); ok {
+		o.transport = nil
+	}
+
+	return &ClientBuilder{c: newClient(o)}
+}
@@ -0,0 +1,56 @@
+package earnalliance
+
+import (
+	"context"
+	"time"
+)
+
+// FlushResult is the result of sending a batch.
+type FlushResult struct {
+	// The number of events and identifier updates in the batch
+	Events      int
+	Identifiers int
+	// The error of sending the batch, nil if it was sent
+	Err error
+	// The time it took to send the batch, including the retries
+	Latency time.Duration
+}
+
+// DrainStream sends the queue as it is now batch by batch, ignoring the flush cooldown and
+// the maximum number of batches per flush, and passes the result of each batch on the returned
+// channel, e.g. to report the progress of a large backfill. The channel is closed once the queue
+// is drained, or ctx is done. The batches that fail to send are queued again once the queue is
+// drained, like with any flush, so they aren't sent again by the same drain. If the client is
+// closed, the channel only passes a result with ErrClientClosed.
+func (c *Client) DrainStream(ctx context.Context) <-chan FlushResult {
+	results := make(chan FlushResult, 1)
+	if c.closed.Load() {
+		results <- FlushResult{Err: ErrClientClosed}
+		close(results)
+		return results
+	}
+
+	go func() {
+		defer close(results)
+
+		if c.flushSlots != nil {
+			select {
+			case c.flushSlots <- struct{}{}:
+				defer c.releaseFlushSlot()
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		err := c.drain(ctx, 0, func(r FlushResult) {
+			select {
+			case results <- r:
+			case <-ctx.Done():
+			}
+		})
+		if c.onFlush != nil {
+			c.onFlush(FlushTriggerExplicit, err)
+		}
+	}()
+	return results
+}
@@ -0,0 +1,72 @@
+package earnalliance
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainStream(t *testing.T) {
+	transport := &flakyTransport{MemoryTransport: NewMemoryTransport(), fail: map[int]error{2: errors.New("failed")}}
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushOnIdentifier(false).
+		WithMaxBatchesPerFlush(1).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	for i := 0; i < 4; i++ {
+		client.Track("asd", "kill", nil, nil)
+	}
+	client.SetIdentifiers("asd", NewIdentifiers().Discord("d").Build())
+	client.batchSize = 2
+
+	var results []FlushResult
+	for r := range client.DrainStream(context.Background()) {
+		results = append(results, r)
+	}
+
+	require.Len(t, results, 3)
+	// The identifier update goes first, and the events fill the rest of the batch
+	require.Equal(t, 1, results[0].Events)
+	require.Equal(t, 1, results[0].Identifiers)
+	require.Nil(t, results[0].Err)
+	require.Equal(t, 2, results[1].Events)
+	require.NotNil(t, results[1].Err)
+	require.Equal(t, 1, results[2].Events)
+	require.Nil(t, results[2].Err)
+	require.True(t, results[2].Latency > 0)
+
+	// The failed batch is queued again
+	require.Len(t, client.eventQueue, 2)
+	require.Len(t, transport.Events(), 2)
+}
+
+func TestDrainStreamCanceled(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithTransport(NewMemoryTransport()).
+		Build()
+
+	client.Track("asd", "kill", nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, ok := <-client.DrainStream(ctx)
+	require.False(t, ok)
+	require.Len(t, client.eventQueue, 1)
+
+	client.Close()
+	results := client.DrainStream(context.Background())
+	require.Equal(t, FlushResult{Err: ErrClientClosed}, <-results)
+	_, ok = <-results
+	require.False(t, ok)
+}
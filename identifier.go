@@ -1,12 +1,39 @@
 package earnalliance
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+)
 
 // Identifier represents a user's idenfitier which is a string.
 // To remove the identifier from the user, its value should be an empty string.
 // Use the IdentifierFrom function to create these with ease.
+// Note that this makes an identifier that is empty by accident, e.g. from an empty variable,
+// remove the identifier from the user, and there is no way to set it to an empty value.
+// Use RemoveIdentifier to remove identifiers explicitly, and WithStrictIdentifiers
+// to reject the empty identifiers that weren't created by it.
 type Identifier string
 
+// removals are the addresses of the identifiers created by RemoveIdentifier, which tells
+// explicit removals apart from identifiers that are empty by accident. The addresses don't
+// keep the identifiers alive, they are removed from the set once an identifier is collected.
+var removals = struct {
+	lock      sync.Mutex
+	addresses map[uintptr]struct{}
+}{addresses: make(map[uintptr]struct{})}
+
+// isRemoval returns whether id was created by RemoveIdentifier.
+func isRemoval(id *Identifier) bool {
+	removals.lock.Lock()
+	defer removals.lock.Unlock()
+	_, ok := removals.addresses[reflect.ValueOf(id).Pointer()]
+	return ok
+}
+
 // MarshalJSON marshals a Identifier to JSON.
 // This will marshal a null if string is empty.
 // If it's not, it will marshal the string as normal JSON string.
@@ -22,8 +49,174 @@ func IdentifierFrom(s string) *Identifier {
 	return PointerFrom(Identifier(s))
 }
 
-// RemoveIdentifier creates a new Identifier with empty string.
-// Use this to remove any identifier.
+// RemoveIdentifier returns an Identifier with empty string.
+// Use this to remove any identifier. Unlike other empty identifiers,
+// the ones it returns aren't rejected by WithStrictIdentifiers.
 func RemoveIdentifier() *Identifier {
-	return PointerFrom(Identifier(""))
+	id := IdentifierFrom("")
+	addr := reflect.ValueOf(id).Pointer()
+
+	removals.lock.Lock()
+	removals.addresses[addr] = struct{}{}
+	removals.lock.Unlock()
+
+	runtime.SetFinalizer(id, func(*Identifier) {
+		removals.lock.Lock()
+		delete(removals.addresses, addr)
+		removals.lock.Unlock()
+	})
+	return id
+}
+
+// ErrEmptyIdentifier is sent to the error channel by SetIdentifiers with WithStrictIdentifiers,
+// when an identifier is empty, but it wasn't created by RemoveIdentifier.
+var ErrEmptyIdentifier = errors.New("identifier is empty, use RemoveIdentifier to remove it")
+
+// checkEmpty returns an error for the first field of is that is empty, but isn't an explicit removal.
+func (is *Identifiers) checkEmpty() error {
+	for _, f := range identifierFields {
+		if id := *is.field(f); id != nil && *id == "" && !isRemoval(id) {
+			return fmt.Errorf("%w: %s", ErrEmptyIdentifier, f)
+		}
+	}
+	return nil
+}
+
+// IdentifierField names one of the fields of Identifiers.
+// Its value is the JSON name of the field, which is what ties the constants
+// below to the fields, so every field of Identifiers is a valid IdentifierField.
+type IdentifierField string
+
+const (
+	AppleID       IdentifierField = "appleId"
+	DiscordID     IdentifierField = "discordId"
+	Email         IdentifierField = "email"
+	EpicGamesID   IdentifierField = "epicGamesId"
+	SteamID       IdentifierField = "steamId"
+	TwitterID     IdentifierField = "twitterId"
+	WalletAddress IdentifierField = "walletAddress"
+)
+
+// identifierFields are all of the fields of Identifiers in order, and identifierFieldIndex
+// maps them to their index in the struct. Both are read from the JSON tags of the struct,
+// so it is the only place where the fields are listed.
+var identifierFields, identifierFieldIndex = indexIdentifierFields()
+
+func indexIdentifierFields() ([]IdentifierField, map[IdentifierField]int) {
+	t := reflect.TypeOf(Identifiers{})
+	fields := make([]IdentifierField, t.NumField())
+	index := make(map[IdentifierField]int, t.NumField())
+	for i := range fields {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		fields[i] = IdentifierField(name)
+		index[fields[i]] = i
+	}
+	return fields, index
+}
+
+// field returns a pointer to the field of is that f names.
+// It panics if f is not a known field.
+func (is *Identifiers) field(f IdentifierField) **Identifier {
+	i, ok := identifierFieldIndex[f]
+	if !ok {
+		panic("unknown identifier field: " + string(f))
+	}
+	return reflect.ValueOf(is).Elem().Field(i).Addr().Interface().(**Identifier)
+}
+
+// Remove marks the fields to be removed from the user, e.g. to unlink their Discord.
+// It panics if one of the fields is not a known field.
+func (is *Identifiers) Remove(fields ...IdentifierField) {
+	for _, f := range fields {
+		*is.field(f) = RemoveIdentifier()
+	}
+}
+
+// validate runs the validators of the fields of is that are set and not removed,
+// and returns is without the fields that failed, along with an error for each of them.
+// If reject is set, nil is returned instead if any of them failed. The fields of is are kept.
+func (is *Identifiers) validate(validators map[IdentifierField]func(value string) error, reject bool) (*Identifiers, []error) {
+	valid := *is
+	var errs []error
+	for _, f := range identifierFields {
+		validator := validators[f]
+		id := valid.field(f)
+		if validator == nil || *id == nil || **id == "" {
+			continue
+		}
+		if err := validator(string(**id)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f, err))
+			*id = nil
+		}
+	}
+	if reject && len(errs) > 0 {
+		return nil, errs
+	}
+	return &valid, errs
+}
+
+// IdentifiersBuilder builds Identifiers fluently. It is not concurrency safe.
+// Fields that are never set are omitted, just like nil pointers in Identifiers.
+type IdentifiersBuilder struct {
+	is Identifiers
+}
+
+// NewIdentifiers creates a new IdentifiersBuilder without any fields set.
+func NewIdentifiers() *IdentifiersBuilder {
+	return &IdentifiersBuilder{}
+}
+
+// Set sets the field to id. An empty id removes the identifier from the user,
+// prefer Remove to make that intent explicit.
+func (ib *IdentifiersBuilder) Set(field IdentifierField, id string) *IdentifiersBuilder {
+	*ib.is.field(field) = IdentifierFrom(id)
+	return ib
+}
+
+// Remove marks the fields to be removed from the user.
+func (ib *IdentifiersBuilder) Remove(fields ...IdentifierField) *IdentifiersBuilder {
+	ib.is.Remove(fields...)
+	return ib
+}
+
+// Apple sets the Apple ID.
+func (ib *IdentifiersBuilder) Apple(id string) *IdentifiersBuilder {
+	return ib.Set(AppleID, id)
+}
+
+// Discord sets the Discord ID.
+func (ib *IdentifiersBuilder) Discord(id string) *IdentifiersBuilder {
+	return ib.Set(DiscordID, id)
+}
+
+// Email sets the email.
+func (ib *IdentifiersBuilder) Email(email string) *IdentifiersBuilder {
+	return ib.Set(Email, email)
+}
+
+// EpicGames sets the Epic Games ID.
+func (ib *IdentifiersBuilder) EpicGames(id string) *IdentifiersBuilder {
+	return ib.Set(EpicGamesID, id)
+}
+
+// Steam sets the Steam ID.
+func (ib *IdentifiersBuilder) Steam(id string) *IdentifiersBuilder {
+	return ib.Set(SteamID, id)
+}
+
+// Twitter sets the Twitter ID.
+func (ib *IdentifiersBuilder) Twitter(id string) *IdentifiersBuilder {
+	return ib.Set(TwitterID, id)
+}
+
+// WalletAddress sets the wallet address.
+func (ib *IdentifiersBuilder) WalletAddress(address string) *IdentifiersBuilder {
+	return ib.Set(WalletAddress, address)
+}
+
+// Build returns the Identifiers that were built.
+// The builder can keep being used without affecting the returned value.
+func (ib *IdentifiersBuilder) Build() *Identifiers {
+	is := ib.is
+	return &is
 }
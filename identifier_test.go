@@ -0,0 +1,112 @@
+package earnalliance
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentifiersBuilder(t *testing.T) {
+	testCases := []struct {
+		name     string
+		builder  *IdentifiersBuilder
+		expected *Identifiers
+	}{
+		{
+			name:     "empty",
+			builder:  NewIdentifiers(),
+			expected: &Identifiers{},
+		},
+		{
+			name:    "all fields",
+			builder: NewIdentifiers().Apple("a").Discord("d").Email("e").EpicGames("eg").Steam("s").Twitter("t").WalletAddress("w"),
+			expected: &Identifiers{
+				AppleID:       IdentifierFrom("a"),
+				DiscordID:     IdentifierFrom("d"),
+				Email:         IdentifierFrom("e"),
+				EpicGamesID:   IdentifierFrom("eg"),
+				SteamID:       IdentifierFrom("s"),
+				TwitterId:     IdentifierFrom("t"),
+				WalletAddress: IdentifierFrom("w"),
+			},
+		},
+		{
+			name:    "set and remove",
+			builder: NewIdentifiers().Discord("x").Steam("y").Remove(TwitterID),
+			expected: &Identifiers{
+				DiscordID: IdentifierFrom("x"),
+				SteamID:   IdentifierFrom("y"),
+				TwitterId: RemoveIdentifier(),
+			},
+		},
+		{
+			name:    "remove overrides set",
+			builder: NewIdentifiers().Discord("x").Remove(DiscordID, Email),
+			expected: &Identifiers{
+				DiscordID: RemoveIdentifier(),
+				Email:     RemoveIdentifier(),
+			},
+		},
+		{
+			name:    "set by field",
+			builder: NewIdentifiers().Set(WalletAddress, "w"),
+			expected: &Identifiers{
+				WalletAddress: IdentifierFrom("w"),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.builder.Build())
+		})
+	}
+
+	t.Run("builds the same JSON as the struct literal", func(t *testing.T) {
+		a, err := json.Marshal(NewIdentifiers().Discord("x").Remove(TwitterID).Build())
+		require.Nil(t, err)
+		b, err := json.Marshal(&Identifiers{DiscordID: IdentifierFrom("x"), TwitterId: RemoveIdentifier()})
+		require.Nil(t, err)
+		require.Equal(t, string(b), string(a))
+		require.Equal(t, `{"discordId":"x","twitterId":null}`, string(a))
+	})
+
+	t.Run("build returns a copy", func(t *testing.T) {
+		ib := NewIdentifiers().Discord("x")
+		is := ib.Build()
+		ib.Steam("y")
+		require.Nil(t, is.SteamID)
+	})
+
+	t.Run("unknown field", func(t *testing.T) {
+		require.PanicsWithValue(t, "unknown identifier field: nope", func() {
+			NewIdentifiers().Remove("nope")
+		})
+	})
+}
+
+func TestIdentifiersRemove(t *testing.T) {
+	is := &Identifiers{DiscordID: IdentifierFrom("d"), SteamID: IdentifierFrom("s")}
+	is.Remove(DiscordID, Email)
+
+	require.Equal(t, &Identifiers{
+		DiscordID: RemoveIdentifier(),
+		Email:     RemoveIdentifier(),
+		SteamID:   IdentifierFrom("s"),
+	}, is)
+}
+
+func TestIdentifierFields(t *testing.T) {
+	// Every field of Identifiers needs a constant
+	require.Equal(t, []IdentifierField{AppleID, DiscordID, Email, EpicGamesID, SteamID, TwitterID, WalletAddress}, identifierFields)
+
+	for _, f := range identifierFields {
+		is := &Identifiers{}
+		is.Remove(f)
+
+		b, err := json.Marshal(is)
+		require.Nil(t, err)
+		require.Equal(t, `{"`+string(f)+`":null}`, string(b))
+	}
+}
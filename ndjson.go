@@ -0,0 +1,56 @@
+package earnalliance
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// ndjsonContentType is the content type of the payloads encoded with PayloadEncodingNDJSON.
+const ndjsonContentType = "application/x-ndjson"
+
+// ndjsonLine is a line of a payload encoded with PayloadEncodingNDJSON,
+// which is either an event or an identifier update.
+type ndjsonLine struct {
+	GameID      string           `json:"gameId"`
+	Event       any              `json:"event,omitempty"`
+	Identifiers *UserIdentifiers `json:"identifiers,omitempty"`
+}
+
+// marshalNDJSON marshals the events of p, followed by its identifier updates, one per line,
+// with the custom marshaler if there is one, otherwise they are encoded into buf.
+// Every line ends with a newline, including the last one.
+func (c *Client) marshalNDJSON(buf *bytes.Buffer, p *payload) ([]byte, error) {
+	lines := make([]ndjsonLine, 0, len(p.Events)+len(p.Identifiers))
+	for i := range p.Events {
+		var e any = &p.Events[i]
+		if c.valueFormatter != nil {
+			e = &formattedEvent{Event: p.Events[i], Value: c.valueFormatter(p.Events[i].Value)}
+		}
+		lines = append(lines, ndjsonLine{GameID: p.GameID, Event: e})
+	}
+	for i := range p.Identifiers {
+		lines = append(lines, ndjsonLine{GameID: p.GameID, Identifiers: &p.Identifiers[i]})
+	}
+
+	buf.Reset()
+	enc := json.NewEncoder(buf)
+	for i := range lines {
+		if c.marshaler == nil {
+			if err := enc.Encode(&lines[i]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		b, err := c.marshaler(&lines[i])
+		if err != nil {
+			return nil, err
+		}
+		// A custom marshaler may produce indented JSON, which has to fit on one line
+		if err := json.Compact(buf, b); err != nil {
+			return nil, err
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
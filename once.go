@@ -0,0 +1,83 @@
+package earnalliance
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultTrackOnceMaxKeys is the number of keys remembered by TrackOnce,
+// unless another one is set via WithTrackOnceRetention.
+const defaultTrackOnceMaxKeys = 10000
+
+// TrackOnce submits an event to the event queue just like Track, unless an event with the
+// same key was already submitted by TrackOnce, e.g. for milestones like completing the tutorial,
+// which should only be sent once per user. The key is the user ID and the event name by default,
+// which can be changed via WithTrackOnceKey. The keys are remembered for the lifetime of the client,
+// or for the retention set via WithTrackOnceRetention, and only up to a maximum number of them,
+// after which the oldest ones are forgotten. The keys aren't shared between clients or processes.
+func (c *Client) TrackOnce(userID string, eventName string, value *int, traits Traits) {
+	if !c.once.mark(c.onceKey(userID, eventName), c.clock.Now(), c.onceRetention, c.onceMaxKeys) {
+		return
+	}
+	c.Track(userID, eventName, value, traits)
+}
+
+// onceKey returns the key of an event submitted by TrackOnce.
+func (c *Client) onceKey(userID string, eventName string) string {
+	if c.trackOnceKey != nil {
+		return c.trackOnceKey(userID, eventName)
+	}
+	return userID + "\x00" + eventName
+}
+
+// onceMarkers are the keys of the events submitted by TrackOnce.
+type onceMarkers struct {
+	lock sync.Mutex
+	seen map[string]time.Time
+	// The keys in the order they were marked, which can contain keys
+	// that were marked again since, which are skipped when they are removed
+	order []onceMarker
+}
+
+type onceMarker struct {
+	key string
+	at  time.Time
+}
+
+// mark records key at now, and reports whether it wasn't recorded yet, or its record
+// is older than retention, which is unlimited if 0. If there are more than maxKeys records,
+// the oldest ones are removed.
+func (m *onceMarkers) mark(key string, now time.Time, retention time.Duration, maxKeys int) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if at, ok := m.seen[key]; ok && (retention == 0 || now.Sub(at) < retention) {
+		return false
+	}
+
+	// Remove the expired records, and make room for the new one
+	for len(m.order) > 0 {
+		oldest := m.order[0]
+		if len(m.seen) < maxKeys && (retention == 0 || now.Sub(oldest.at) < retention) {
+			break
+		}
+		m.order = m.order[1:]
+		if m.seen[oldest.key].Equal(oldest.at) {
+			delete(m.seen, oldest.key)
+		}
+	}
+
+	if m.seen == nil {
+		m.seen = make(map[string]time.Time)
+	}
+	m.seen[key] = now
+	m.order = append(m.order, onceMarker{key: key, at: now})
+	return true
+}
+
+// remove removes the record of key, its entry in order is skipped once it is the oldest.
+func (m *onceMarkers) remove(key string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.seen, key)
+}
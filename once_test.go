@@ -0,0 +1,83 @@
+package earnalliance
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackOnce(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	client.TrackOnce("asd", "TUTORIAL_COMPLETE", nil, nil)
+	client.TrackOnce("asd", "TUTORIAL_COMPLETE", nil, nil)
+	client.TrackOnce("qwe", "TUTORIAL_COMPLETE", nil, nil)
+	client.TrackOnce("asd", "LEVEL_10", nil, nil)
+	// Track isn't affected
+	client.Track("asd", "TUTORIAL_COMPLETE", nil, nil)
+
+	require.Len(t, client.eventQueue, 4)
+}
+
+func TestTrackOnceKey(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithTransport(NewMemoryTransport()).
+		WithTrackOnceKey(func(userID string, eventName string) string {
+			return eventName
+		}).
+		Build()
+	defer client.Close()
+
+	client.TrackOnce("asd", "FIRST_BLOOD", nil, nil)
+	client.TrackOnce("qwe", "FIRST_BLOOD", nil, nil)
+
+	require.Len(t, client.eventQueue, 1)
+	require.Equal(t, "asd", client.eventQueue[0].UserID)
+}
+
+func TestTrackOnceRetention(t *testing.T) {
+	clock := newFakeClock()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithTransport(NewMemoryTransport()).
+		WithClock(clock).
+		WithTrackOnceRetention(time.Hour, 2).
+		Build()
+	defer client.Close()
+
+	client.TrackOnce("asd", "kill", nil, nil)
+	clock.Advance(59 * time.Minute)
+	client.TrackOnce("asd", "kill", nil, nil)
+	require.Len(t, client.eventQueue, 1)
+
+	// The key is forgotten once the retention passed
+	clock.Advance(time.Minute)
+	client.TrackOnce("asd", "kill", nil, nil)
+	require.Len(t, client.eventQueue, 2)
+
+	// The oldest keys are forgotten beyond the maximum
+	client.TrackOnce("qwe", "kill", nil, nil)
+	client.TrackOnce("zxc", "kill", nil, nil)
+	client.TrackOnce("asd", "kill", nil, nil)
+	require.Len(t, client.eventQueue, 5)
+	client.TrackOnce("zxc", "kill", nil, nil)
+	require.Len(t, client.eventQueue, 5)
+
+	require.Panics(t, func() { NewClientBuilder().WithTrackOnceRetention(-time.Second, 1) })
+	require.Panics(t, func() { NewClientBuilder().WithTrackOnceRetention(0, 0) })
+}
@@ -0,0 +1,118 @@
+package earnalliance
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Queue stores events and identifier updates until they are sent, e.g. in a durable store,
+// or in one that is shared by multiple processes, like Redis or SQS. It is set via WithQueue,
+// by default the client keeps the items in memory. It must be safe for concurrent use.
+type Queue interface {
+	// Enqueue adds the item to the back of the queue.
+	Enqueue(item QueueItem) error
+	// DequeueBatch removes up to n items from the front of the queue and returns them.
+	DequeueBatch(n int) ([]QueueItem, error)
+	// Len returns the number of queued items.
+	// It is called every time an item is queued, so it should be fast.
+	Len() int
+}
+
+// QueueItem is an item of a Queue, which is either an event or an identifier update.
+// It can be stored as JSON, which keeps the removals of identifiers, unlike the JSON of
+// the identifier update alone, where they are null.
+type QueueItem struct {
+	Event       *Event           `json:"event,omitempty"`
+	Identifiers *UserIdentifiers `json:"identifiers,omitempty"`
+}
+
+// queueItemJSON is the JSON encoding of a QueueItem.
+type queueItemJSON struct {
+	Event       *Event           `json:"event,omitempty"`
+	Identifiers *UserIdentifiers `json:"identifiers,omitempty"`
+	// The fields of Identifiers that are removed
+	Removed  []IdentifierField `json:"removed,omitempty"`
+	QueuedAt *time.Time        `json:"queuedAt,omitempty"`
+}
+
+// MarshalJSON marshals the item along with the removals and the queue time of its identifier update.
+func (qi QueueItem) MarshalJSON() ([]byte, error) {
+	j := queueItemJSON{Event: qi.Event, Identifiers: qi.Identifiers}
+	if u := qi.Identifiers; u != nil {
+		for _, f := range identifierFields {
+			if id := *u.Identifiers.field(f); id != nil && *id == "" {
+				j.Removed = append(j.Removed, f)
+			}
+		}
+		if !u.queuedAt.IsZero() {
+			j.QueuedAt = &u.queuedAt
+		}
+	}
+	return json.Marshal(&j)
+}
+
+// UnmarshalJSON unmarshals an item marshalled by MarshalJSON.
+func (qi *QueueItem) UnmarshalJSON(b []byte) error {
+	var j queueItemJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if u := j.Identifiers; u != nil {
+		for _, f := range j.Removed {
+			if _, ok := identifierFieldIndex[f]; ok {
+				*u.Identifiers.field(f) = RemoveIdentifier()
+			}
+		}
+		if j.QueuedAt != nil {
+			u.queuedAt = *j.QueuedAt
+		}
+	}
+	*qi = QueueItem{Event: j.Event, Identifiers: j.Identifiers}
+	return nil
+}
+
+// enqueue adds the item to the queue set via WithQueue.
+func (c *Client) enqueue(item QueueItem) {
+	if err := c.queue.Enqueue(item); err != nil {
+		c.reportError(fmt.Errorf("failed to queue item: %w", err))
+	}
+}
+
+// dequeueBatch removes up to n items from the queue set via WithQueue and returns them.
+func (c *Client) dequeueBatch(n int) ([]Event, []UserIdentifiers, error) {
+	items, err := c.queue.DequeueBatch(n)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to dequeue batch: %w", err)
+	}
+
+	var events []Event
+	var identifiers []UserIdentifiers
+	for _, item := range items {
+		switch {
+		case item.Event != nil:
+			events = append(events, *item.Event)
+		case item.Identifiers != nil:
+			identifiers = append(identifiers, *item.Identifiers)
+		}
+	}
+	return events, identifiers, nil
+}
+
+// queueExternally adds the items to the queue set via WithQueue,
+// and reports whether the queues hold a full batch.
+func (c *Client) queueExternally(kind QueueKind, items ...QueueItem) bool {
+	for _, item := range items {
+		c.enqueue(item)
+	}
+
+	c.queueLock.Lock()
+	full := c.queueSize() >= c.batchSize
+	c.queueLock.Unlock()
+
+	if c.queueObserver != nil {
+		c.queueObserver(kind, c.queue.Len())
+	}
+
+	return full
+}
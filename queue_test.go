@@ -0,0 +1,217 @@
+package earnalliance
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// sliceQueue is a Queue that keeps the items in a slice.
+type sliceQueue struct {
+	lock       sync.Mutex
+	items      []QueueItem
+	dequeueErr error
+}
+
+func (q *sliceQueue) Enqueue(item QueueItem) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.items = append(q.items, item)
+	return nil
+}
+
+func (q *sliceQueue) DequeueBatch(n int) ([]QueueItem, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.dequeueErr != nil {
+		return nil, q.dequeueErr
+	}
+	n = min(n, len(q.items))
+	items := q.items[:n]
+	q.items = q.items[n:]
+	return items, nil
+}
+
+func (q *sliceQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.items)
+}
+
+// jsonQueue is a Queue that stores its items as JSON, like a queue in Redis would.
+type jsonQueue struct {
+	lock  sync.Mutex
+	items [][]byte
+}
+
+func (q *jsonQueue) Enqueue(item QueueItem) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.items = append(q.items, b)
+	return nil
+}
+
+func (q *jsonQueue) DequeueBatch(n int) ([]QueueItem, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	n = min(n, len(q.items))
+	items := make([]QueueItem, n)
+	for i, b := range q.items[:n] {
+		if err := json.Unmarshal(b, &items[i]); err != nil {
+			return nil, err
+		}
+	}
+	q.items = q.items[n:]
+	return items, nil
+}
+
+func (q *jsonQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.items)
+}
+
+func TestQueue(t *testing.T) {
+	transport := NewMemoryTransport()
+	queue := &sliceQueue{}
+	var depths []int
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithFlushInterval(time.Hour).
+		WithFlushOnIdentifier(false).
+		WithBatchSize(3).
+		WithAsyncBatchFlush(false).
+		WithTransport(transport).
+		WithQueue(queue).
+		WithQueueObserver(func(kind QueueKind, depth int) {
+			depths = append(depths, depth)
+		}).
+		Build()
+	defer client.Close()
+
+	client.SetIdentifiers("asd", NewIdentifiers().Discord("d").Build())
+	client.Track("asd", "kill", nil, nil)
+	require.Empty(t, client.eventQueue)
+	require.Empty(t, client.identifierQueue)
+	require.Equal(t, 2, queue.Len())
+	require.Equal(t, []int{1, 2}, depths)
+
+	// A full batch is sent from the queue
+	client.Track("asd", "death", nil, nil)
+	require.Zero(t, queue.Len())
+	require.Len(t, transport.Payloads(), 1)
+	require.Len(t, transport.Identifiers(), 1)
+	require.Equal(t, "kill", transport.Events()[0].Event)
+	require.Equal(t, "death", transport.Events()[1].Event)
+	transport.Reset()
+
+	// Errors of the queue are returned by the flush
+	queue.dequeueErr = errors.New("unavailable")
+	client.Track("asd", "kill", nil, nil)
+	err := client.Flush()
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "failed to dequeue batch: unavailable")
+	require.Equal(t, 1, queue.Len())
+
+	queue.dequeueErr = nil
+	require.Nil(t, client.Flush())
+	require.Len(t, transport.Events(), 1)
+}
+
+func TestQueueRequeue(t *testing.T) {
+	transport := &flakyTransport{MemoryTransport: NewMemoryTransport(), fail: map[int]error{1: errors.New("failed")}}
+	queue := &sliceQueue{}
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithTransport(transport).
+		WithQueue(queue).
+		Build()
+	defer client.Close()
+
+	client.Track("asd", "kill", nil, nil)
+	require.NotNil(t, client.Flush())
+
+	// The items that couldn't be sent are kept in memory, and sent before the ones of the queue
+	require.Len(t, client.eventQueue, 1)
+	client.Track("asd", "death", nil, nil)
+	require.Equal(t, 1, queue.Len())
+
+	require.Nil(t, client.Flush())
+	require.Zero(t, client.queueSize())
+	require.Equal(t, "kill", transport.Events()[0].Event)
+	require.Equal(t, "death", transport.Events()[1].Event)
+}
+
+func TestQueueClone(t *testing.T) {
+	transport := NewMemoryTransport()
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("game-a").
+		WithFlushCooldown(0).
+		WithTransport(transport).
+		WithQueue(&sliceQueue{}).
+		Build()
+	defer client.Close()
+
+	clone := client.Clone().WithGameID("game-b").Build()
+	defer clone.Close()
+
+	client.Track("asd", "kill", nil, nil)
+	require.Nil(t, clone.Flush())
+	require.Empty(t, transport.Payloads())
+
+	require.Nil(t, client.Flush())
+	require.Len(t, transport.Payloads(), 1)
+	require.Contains(t, string(transport.Payloads()[0]), `"gameId":"game-a"`)
+}
+
+func TestQueueJSON(t *testing.T) {
+	transport := NewMemoryTransport()
+	queue := &jsonQueue{}
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithTransport(transport).
+		WithFlushOnIdentifier(false).
+		WithQueue(queue).
+		Build()
+	defer client.Close()
+
+	client.SetIdentifiers("asd", NewIdentifiers().Remove(DiscordID).Steam("s").Build())
+	client.Track("asd", "kill", PointerFrom(1), nil)
+
+	// The removal and the queue time survive the round trip
+	items, err := queue.DequeueBatch(1)
+	require.Nil(t, err)
+	require.Len(t, items, 1)
+	require.NotNil(t, items[0].Identifiers.DiscordID)
+	require.Equal(t, Identifier(""), *items[0].Identifiers.DiscordID)
+	require.False(t, items[0].Identifiers.queuedAt.IsZero())
+	require.Nil(t, queue.Enqueue(items[0]))
+
+	require.Nil(t, client.Flush())
+	require.Equal(t, `{"gameId":"c","events":[{"userId":"asd","time":"`+transport.Events()[0].Time+
+		`","event":"kill","groupId":"","value":1}],"identifiers":[{"userId":"asd","discordId":null,"steamId":"s"}]}`,
+		string(transport.Payloads()[0]))
+}
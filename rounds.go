@@ -0,0 +1,37 @@
+package earnalliance
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrDuplicateRoundID is sent to the error channel by StartRound with WithUniqueRoundIDs,
+// when a round is started with the ID of a round that wasn't ended yet.
+var ErrDuplicateRoundID = errors.New("round id is already in use")
+
+// activeRounds are the IDs of the rounds that were started and not ended yet.
+type activeRounds struct {
+	lock sync.Mutex
+	ids  map[string]struct{}
+}
+
+// add adds id, and reports whether it wasn't active yet.
+func (r *activeRounds) add(id string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.ids[id]; ok {
+		return false
+	}
+	if r.ids == nil {
+		r.ids = make(map[string]struct{})
+	}
+	r.ids[id] = struct{}{}
+	return true
+}
+
+func (r *activeRounds) remove(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.ids, id)
+}
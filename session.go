@@ -0,0 +1,35 @@
+package earnalliance
+
+import "time"
+
+const (
+	// StartGameSessionTrait is the trait of the event submitted by StartGameSession
+	// that carries the session ID, so the API can tell the sessions of a user apart.
+	StartGameSessionTrait = "sessionId"
+
+	defaultStartGameSessionTimeout = 30 * time.Minute
+	// The number of sessions remembered by StartGameSession, beyond which the oldest ones are forgotten
+	maxStartGameSessions = 10000
+)
+
+// StartGameSession submits the start game event just like StartGame, with the session ID under
+// the StartGameSessionTrait trait, unless it was already submitted for the same user and session
+// within the session timeout set via WithStartGameSessionTimeout. So game code that starts a
+// session more than once only sends it once, while each of the concurrent sessions of a user,
+// e.g. on two devices, still sends its own. EndGameSession forgets the session before the timeout.
+func (c *Client) StartGameSession(userID string, sessionID string) {
+	if !c.sessions.mark(sessionKey(userID, sessionID), c.clock.Now(), c.startGameSessionTimeout, maxStartGameSessions) {
+		return
+	}
+	c.startGame(userID, Traits{StartGameSessionTrait: sessionID})
+}
+
+// EndGameSession forgets the session of the user, so the next StartGameSession
+// with the same session ID submits the start game event again.
+func (c *Client) EndGameSession(userID string, sessionID string) {
+	c.sessions.remove(sessionKey(userID, sessionID))
+}
+
+func sessionKey(userID string, sessionID string) string {
+	return userID + "\x00" + sessionID
+}
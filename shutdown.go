@@ -0,0 +1,65 @@
+package earnalliance
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrShutdownTimeout is returned by Close when it couldn't send what is queued
+// within the timeout set via WithShutdownTimeout.
+var ErrShutdownTimeout = errors.New("shutdown timed out before the queue was sent")
+
+// drainOnClose sends what is queued until ctx is done, and spools what is left if it is.
+func (c *Client) drainOnClose(ctx context.Context) error {
+	var err error
+	if c.flushSlots != nil {
+		select {
+		case c.flushSlots <- struct{}{}:
+			defer c.releaseFlushSlot()
+			err = c.drain(ctx, 0, nil)
+		case <-ctx.Done():
+		}
+	} else {
+		err = c.drain(ctx, 0, nil)
+	}
+	if c.onFlush != nil {
+		c.onFlush(FlushTriggerClose, err)
+	}
+
+	if ctx.Err() == nil {
+		return err
+	}
+	if c.spoolPath != "" {
+		err = errors.Join(err, c.spoolQueued())
+	}
+	if err == nil {
+		return ErrShutdownTimeout
+	}
+	return fmt.Errorf("%w: %w", ErrShutdownTimeout, err)
+}
+
+// spoolQueued removes what is queued in memory and appends it to the spool file in batches.
+// The items of the queue set via WithQueue are left there.
+func (c *Client) spoolQueued() error {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer putBuffer(buf)
+
+	var errs []error
+	for {
+		events, identifiers, _ := c.takeQueued()
+		if len(events) == 0 && len(identifiers) == 0 {
+			return errors.Join(errs...)
+		}
+
+		m, err := c.marshalPayload(buf, &payload{GameID: c.gameID, Events: events, Identifiers: identifiers})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to marshal payload: %w", err))
+			continue
+		}
+		if err := c.spool(m); err != nil {
+			errs = append(errs, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package earnalliance
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// hangingTransport never responds, until the context is done.
+type hangingTransport struct{}
+
+func (hangingTransport) Send(ctx context.Context, _ []byte, _ map[string]string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	transport := NewMemoryTransport()
+	var triggers []FlushTrigger
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithTransport(transport).
+		WithShutdownTimeout(time.Second).
+		WithOnFlush(func(trigger FlushTrigger, err error) {
+			triggers = append(triggers, trigger)
+		}).
+		Build()
+
+	client.Track("asd", "kill", nil, nil)
+	client.Track("asd", "death", nil, nil)
+	require.Nil(t, client.Close())
+
+	require.Len(t, transport.Events(), 2)
+	require.Equal(t, []FlushTrigger{FlushTriggerClose}, triggers)
+	require.Nil(t, client.Close())
+}
+
+func TestShutdownTimeoutExpired(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithTransport(hangingTransport{}).
+		WithShutdownTimeout(50 * time.Millisecond).
+		Build()
+
+	client.Track("asd", "kill", nil, nil)
+
+	start := time.Now()
+	err := client.Close()
+	require.True(t, errors.Is(err, ErrShutdownTimeout), err)
+	require.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	require.True(t, time.Since(start) < time.Second)
+
+	// The unsent items are kept
+	require.Len(t, client.eventQueue, 1)
+}
+
+func TestShutdownTimeoutSpool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.ndjson")
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithTransport(hangingTransport{}).
+		WithOfflineSpool(path).
+		WithShutdownTimeout(50 * time.Millisecond).
+		Build()
+
+	for i := 0; i < 3; i++ {
+		client.Track("asd", "kill", nil, nil)
+	}
+	client.batchSize = 2
+
+	err := client.Close()
+	require.True(t, errors.Is(err, ErrShutdownTimeout), err)
+
+	// The batch that timed out is spooled when it fails, and the rest of the queue on top
+	require.Empty(t, client.eventQueue)
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, 2, bytes.Count(b, []byte("\n")))
+}
+
+// failingTransport fails every send, and blocks the second one until it is released.
+type failingTransport struct {
+	sends   atomic.Int32
+	sending chan struct{}
+	release chan struct{}
+}
+
+func (t *failingTransport) Send(context.Context, []byte, map[string]string) error {
+	if t.sends.Add(1) == 2 {
+		t.sending <- struct{}{}
+		<-t.release
+	}
+	return errors.New("fail")
+}
+
+func TestCloseDuringFailedFlush(t *testing.T) {
+	transport := &failingTransport{sending: make(chan struct{}), release: make(chan struct{})}
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(10 * time.Millisecond).
+		WithTransport(transport).
+		Build()
+
+	client.Track("asd", "kill", nil, nil)
+	require.NotNil(t, client.Flush())
+	// The failed event is sent by the waiter after the cooldown
+	require.Nil(t, client.Flush())
+	<-transport.sending
+
+	require.Nil(t, client.Close())
+	close(transport.release)
+
+	// The waiter doesn't schedule another flush for the event it put back in the queue
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, int32(2), transport.sends.Load())
+}
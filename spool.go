@@ -0,0 +1,110 @@
+package earnalliance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// sendOrSpool sends msg, and appends it to the spool file if that fails,
+// so it can be sent again with ReplaySpool. The error of the send is returned either way,
+// along with whether msg was spooled.
+func (c *Client) sendOrSpool(ctx context.Context, msg []byte) (spooled bool, err error) {
+	err = c.send(ctx, msg)
+	if err == nil || c.spoolPath == "" {
+		return false, err
+	}
+
+	if spoolErr := c.spool(msg); spoolErr != nil {
+		return false, errors.Join(err, spoolErr)
+	}
+	return true, err
+}
+
+// spool appends msg to the spool file as a single line.
+func (c *Client) spool(msg []byte) error {
+	var line bytes.Buffer
+	// A custom marshaler may produce indented JSON, which has to fit on one line
+	if err := json.Compact(&line, msg); err != nil {
+		return fmt.Errorf("failed to spool payload: %w", err)
+	}
+	line.WriteByte('\n')
+
+	c.spoolLock.Lock()
+	defer c.spoolLock.Unlock()
+
+	f, err := os.OpenFile(c.spoolPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to spool payload: %w", err)
+	}
+	if _, err := f.Write(line.Bytes()); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to spool payload: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to spool payload: %w", err)
+	}
+	return nil
+}
+
+// ReplaySpool sends the payloads in the spool file set with WithOfflineSpool again,
+// e.g. once the network is back. The payloads that are sent are removed from the file,
+// the ones that fail again are kept and their errors are joined.
+// If ctx is done, the remaining payloads are kept without sending them.
+// It counts as a flush in flight for WithMaxInFlightFlushes.
+// It does nothing if there is no spool file.
+func (c *Client) ReplaySpool(ctx context.Context) error {
+	if c.spoolPath == "" {
+		return nil
+	}
+
+	if err := c.acquireFlushSlot(ctx); err != nil {
+		return err
+	}
+	defer c.releaseFlushSlot()
+
+	c.spoolLock.Lock()
+	defer c.spoolLock.Unlock()
+
+	data, err := os.ReadFile(c.spoolPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read spool: %w", err)
+	}
+
+	var kept bytes.Buffer
+	var errs []error
+	for _, msg := range bytes.Split(data, []byte("\n")) {
+		if len(msg) == 0 {
+			continue
+		}
+
+		if ctx.Err() == nil {
+			err = c.send(ctx, msg)
+			if err == nil {
+				continue
+			}
+		} else {
+			err = ctx.Err()
+		}
+
+		kept.Write(msg)
+		kept.WriteByte('\n')
+		errs = append(errs, err)
+	}
+
+	if kept.Len() == 0 {
+		if err := os.Remove(c.spoolPath); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove spool: %w", err))
+		}
+	} else if err := os.WriteFile(c.spoolPath, kept.Bytes(), 0o600); err != nil {
+		errs = append(errs, fmt.Errorf("failed to rewrite spool: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
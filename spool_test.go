@@ -0,0 +1,102 @@
+package earnalliance_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ea "github.com/earn-alliance/earnalliance-go"
+	"github.com/stretchr/testify/require"
+)
+
+// offlineTransport fails every request while offline is set.
+type offlineTransport struct {
+	*ea.MemoryTransport
+	offline bool
+}
+
+func (t *offlineTransport) Send(ctx context.Context, payload []byte, headers map[string]string) error {
+	if t.offline {
+		return errors.New("offline")
+	}
+	return t.MemoryTransport.Send(ctx, payload, headers)
+}
+
+func TestOfflineSpool(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.ndjson")
+	transport := &offlineTransport{MemoryTransport: ea.NewMemoryTransport(), offline: true}
+
+	client := ea.NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithTransport(transport).
+		WithOfflineSpool(path).
+		Build()
+	defer client.Close()
+
+	// Nothing is spooled yet
+	require.Nil(t, client.ReplaySpool(context.Background()))
+
+	client.Track("asd", "kill", nil, nil)
+	require.NotNil(t, client.Flush())
+	client.Track("asd", "death", nil, nil)
+	require.NotNil(t, client.Flush())
+
+	b, err := os.ReadFile(path)
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], `"event":"kill"`)
+	require.Contains(t, lines[1], `"event":"death"`)
+
+	// The payloads are kept while the network is down
+	require.NotNil(t, client.ReplaySpool(context.Background()))
+	b, err = os.ReadFile(path)
+	require.Nil(t, err)
+	require.Len(t, strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"), 2)
+
+	transport.offline = false
+	require.Nil(t, client.ReplaySpool(context.Background()))
+
+	events := transport.Events()
+	require.Len(t, events, 2)
+	require.Equal(t, "kill", events[0].Event)
+	require.Equal(t, "death", events[1].Event)
+
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestOfflineSpoolClone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.ndjson")
+	transport := &offlineTransport{MemoryTransport: ea.NewMemoryTransport(), offline: true}
+
+	client := ea.NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithTransport(transport).
+		WithOfflineSpool(path).
+		Build()
+	defer client.Close()
+
+	clone := client.Clone().Build()
+	defer clone.Close()
+
+	// The clone doesn't write to the spool file of the original
+	clone.Track("asd", "kill", nil, nil)
+	require.NotNil(t, clone.Flush())
+	_, err := os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+
+	client.Track("asd", "kill", nil, nil)
+	require.NotNil(t, client.Flush())
+	_, err = os.Stat(path)
+	require.Nil(t, err)
+}
@@ -0,0 +1,138 @@
+package earnalliance
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the statistics of a client.
+type Stats struct {
+	// The name of the client set via WithName
+	Name string
+	// The number of payloads that were sent, including the failed attempts
+	Sends uint64
+	// The number of bytes of the payloads that were sent, including the failed attempts.
+	// The retries of the transport aren't counted again.
+	BytesSent uint64
+	// The percentiles of the latency of the sends, from the transport being called until it returned.
+	// They are estimated from a histogram, so they are accurate to within about 20%.
+	// They are 0 if nothing was sent yet.
+	LatencyP50 time.Duration
+	LatencyP95 time.Duration
+	LatencyP99 time.Duration
+	// The number of items queued, including the ones in the queue set via WithQueue
+	QueueDepth int
+	// The number of sends that failed, including the ones whose payloads were spooled
+	SendFailures uint64
+	// The number of events and identifier updates that were dropped without being sent
+	Dropped uint64
+}
+
+// Stats returns a snapshot of the statistics of the client since it was built.
+func (c *Client) Stats() Stats {
+	c.queueLock.Lock()
+	depth := c.queueSize()
+	c.queueLock.Unlock()
+
+	return Stats{
+		Name:         c.name,
+		Sends:        c.latency.count(),
+		BytesSent:    c.bytesSent.Load(),
+		LatencyP50:   c.latency.percentile(0.50),
+		LatencyP95:   c.latency.percentile(0.95),
+		LatencyP99:   c.latency.percentile(0.99),
+		QueueDepth:   depth,
+		SendFailures: c.sendFailures.Load(),
+		Dropped:      c.dropped.Load(),
+	}
+}
+
+// emitMetrics passes a snapshot of the stats to the metrics callback every metrics interval,
+// until the client is closed.
+func (c *Client) emitMetrics() {
+	defer close(c.metricsDone)
+
+	ticker := time.NewTicker(c.metricsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.metricsCallback(c.Stats())
+		case <-c.stopMetrics:
+			return
+		}
+	}
+}
+
+const (
+	// The buckets grow by a factor of 2^(1/4), from 1ms to about 65 seconds
+	latencyBucketsPerDoubling = 4
+	latencyBuckets            = 16*latencyBucketsPerDoubling + 1
+	latencyBucketMin          = time.Millisecond
+)
+
+// latencyBounds are the upper bounds of the latency buckets, anything
+// greater than the last bound goes into an extra bucket.
+var latencyBounds = func() (bounds [latencyBuckets]time.Duration) {
+	for i := range bounds {
+		bounds[i] = time.Duration(float64(latencyBucketMin) * math.Pow(2, float64(i)/latencyBucketsPerDoubling))
+	}
+	return bounds
+}()
+
+// latencyHistogram counts latencies in exponential buckets. It only uses atomics,
+// so recording a latency doesn't contend with anything on the send path.
+type latencyHistogram struct {
+	buckets [latencyBuckets + 1]atomic.Uint64
+	// The greatest latency recorded, which caps the estimates
+	max atomic.Int64
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	i := 0
+	for i < latencyBuckets && d > latencyBounds[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+
+	for {
+		max := h.max.Load()
+		if int64(d) <= max || h.max.CompareAndSwap(max, int64(d)) {
+			return
+		}
+	}
+}
+
+func (h *latencyHistogram) count() uint64 {
+	var n uint64
+	for i := range h.buckets {
+		n += h.buckets[i].Load()
+	}
+	return n
+}
+
+// percentile returns the upper bound of the bucket that holds the q-th percentile.
+func (h *latencyHistogram) percentile(q float64) time.Duration {
+	var counts [latencyBuckets + 1]uint64
+	var total uint64
+	for i := range h.buckets {
+		counts[i] = h.buckets[i].Load()
+		total += counts[i]
+	}
+	if total == 0 {
+		return 0
+	}
+
+	max := time.Duration(h.max.Load())
+	rank := uint64(math.Ceil(q * float64(total)))
+	var seen uint64
+	for i, n := range counts {
+		seen += n
+		if seen >= rank && i < latencyBuckets {
+			return min(latencyBounds[i], max)
+		}
+	}
+	return max
+}
@@ -0,0 +1,130 @@
+package earnalliance
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	require.Zero(t, h.percentile(0.5))
+
+	for i := 0; i < 90; i++ {
+		h.record(10 * time.Millisecond)
+	}
+	for i := 0; i < 9; i++ {
+		h.record(100 * time.Millisecond)
+	}
+	h.record(time.Second)
+
+	require.Equal(t, uint64(100), h.count())
+	require.InEpsilon(t, float64(10*time.Millisecond), float64(h.percentile(0.50)), 0.2)
+	require.InEpsilon(t, float64(100*time.Millisecond), float64(h.percentile(0.95)), 0.2)
+	require.InEpsilon(t, float64(100*time.Millisecond), float64(h.percentile(0.99)), 0.2)
+	require.Equal(t, time.Second, h.percentile(1))
+
+	// Latencies beyond the last bucket are capped by the greatest one
+	h.record(5 * time.Minute)
+	require.Equal(t, 5*time.Minute, h.percentile(1))
+}
+
+// slowTransport takes delay to send a payload.
+type slowTransport struct {
+	*MemoryTransport
+	delay time.Duration
+}
+
+func (t *slowTransport) Send(ctx context.Context, payload []byte, headers map[string]string) error {
+	time.Sleep(t.delay)
+	return t.MemoryTransport.Send(ctx, payload, headers)
+}
+
+func TestStats(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithTransport(&slowTransport{MemoryTransport: NewMemoryTransport(), delay: 20 * time.Millisecond}).
+		Build()
+	defer client.Close()
+
+	require.Equal(t, Stats{}, client.Stats())
+
+	for i := 0; i < 3; i++ {
+		client.Track("asd", "kill", nil, nil)
+		require.Nil(t, client.Flush())
+	}
+
+	stats := client.Stats()
+	require.Equal(t, uint64(3), stats.Sends)
+	var bytes uint64
+	for _, p := range client.transport.(*slowTransport).Payloads() {
+		bytes += uint64(len(p))
+	}
+	require.Equal(t, bytes, stats.BytesSent)
+	require.True(t, stats.LatencyP50 >= 20*time.Millisecond)
+	require.True(t, stats.LatencyP99 >= stats.LatencyP50)
+}
+
+func TestStatsCounts(t *testing.T) {
+	transport := &flakyTransport{MemoryTransport: NewMemoryTransport(), fail: map[int]error{1: errors.New("failed")}}
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithFlushOnIdentifier(false).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	client.Track("asd", "kill", nil, nil)
+	client.SetIdentifiers("asd", NewIdentifiers().Discord("d").Build())
+	require.Equal(t, 2, client.Stats().QueueDepth)
+
+	require.NotNil(t, client.Flush())
+	client.PurgeQueue()
+
+	stats := client.Stats()
+	require.Zero(t, stats.QueueDepth)
+	require.Equal(t, uint64(1), stats.SendFailures)
+	require.Equal(t, uint64(2), stats.Dropped)
+}
+
+func TestMetricsInterval(t *testing.T) {
+	snapshots := make(chan Stats, 100)
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithName("metrics").
+		WithTransport(NewMemoryTransport()).
+		WithMetricsInterval(10*time.Millisecond, func(s Stats) {
+			snapshots <- s
+		}).
+		Build()
+
+	client.Track("asd", "kill", nil, nil)
+	for s := range snapshots {
+		if s.QueueDepth == 1 {
+			require.Equal(t, "metrics", s.Name)
+			break
+		}
+	}
+
+	// No snapshots are emitted once Close returned
+	client.Close()
+	n := len(snapshots)
+	time.Sleep(30 * time.Millisecond)
+	require.Equal(t, n, len(snapshots))
+
+	require.Panics(t, func() { NewClientBuilder().WithMetricsInterval(0, func(Stats) {}) })
+	require.Panics(t, func() { NewClientBuilder().WithMetricsInterval(time.Second, nil) })
+}
@@ -0,0 +1,67 @@
+package earnalliance
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// HTTPTap is called after every HTTP attempt made by the client, including retries.
+// The request and response are clones whose bodies can be read freely without
+// affecting the client. The response is nil if the attempt failed with err.
+type HTTPTap func(req *http.Request, res *http.Response, err error)
+
+type tapTransport struct {
+	next http.RoundTripper
+	tap  HTTPTap
+}
+
+func (t *tapTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request, so the body is replaced on a clone
+	sendReq := req.Clone(req.Context())
+	reqBody, err := replaceBody(&sendReq.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	tapReq := req.Clone(req.Context())
+	tapReq.Body = io.NopCloser(bytes.NewReader(reqBody))
+
+	res, err := t.next.RoundTrip(sendReq)
+	if err != nil {
+		t.tap(tapReq, nil, err)
+		return nil, err
+	}
+
+	resBody, err := replaceBody(&res.Body)
+	if err != nil {
+		t.tap(tapReq, nil, err)
+		return nil, err
+	}
+
+	tapRes := *res
+	tapRes.Header = res.Header.Clone()
+	tapRes.Body = io.NopCloser(bytes.NewReader(resBody))
+	tapRes.Request = tapReq
+
+	t.tap(tapReq, &tapRes, nil)
+
+	return res, nil
+}
+
+// replaceBody reads the whole body and replaces it with an identical one,
+// so that the returned bytes can be used without consuming the original.
+func replaceBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+
+	b, err := io.ReadAll(*body)
+	(*body).Close()
+	if err != nil {
+		return nil, err
+	}
+
+	*body = io.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
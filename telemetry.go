@@ -0,0 +1,98 @@
+package earnalliance
+
+const (
+	// DefaultSelfTelemetryUserID is the user ID of the self telemetry events,
+	// unless another one is set via WithSelfTelemetryUserID.
+	DefaultSelfTelemetryUserID = "earnalliance-sdk"
+	// SelfTelemetryDropEvent is the self telemetry event about the events and identifier
+	// updates that were dropped without being sent. Its traits are their counts.
+	SelfTelemetryDropEvent = "SDK_ITEMS_DROPPED"
+	// SelfTelemetrySendFailureEvent is the self telemetry event about the batches that failed
+	// to send. Its traits are their count and the message of the last error.
+	SelfTelemetrySendFailureEvent = "SDK_SEND_FAILED"
+)
+
+// telemetry counts what is reported by the self telemetry events, since the last ones were queued.
+type telemetry struct {
+	droppedEvents      int
+	droppedIdentifiers int
+	sendFailures       int
+	lastSendError      string
+}
+
+// countDrop counts the dropped items for the self telemetry, except for its own events.
+func (c *Client) countDrop(events []Event, identifiers []UserIdentifiers) {
+	if !c.selfTelemetry {
+		return
+	}
+
+	n := 0
+	for i := range events {
+		if events[i].UserID != c.selfTelemetryUserID {
+			n++
+		}
+	}
+
+	c.telemetryLock.Lock()
+	c.telemetry.droppedEvents += n
+	c.telemetry.droppedIdentifiers += len(identifiers)
+	c.telemetryLock.Unlock()
+}
+
+// countSendFailure counts a batch that failed to send for the self telemetry.
+func (c *Client) countSendFailure(err error) {
+	if !c.selfTelemetry {
+		return
+	}
+
+	c.telemetryLock.Lock()
+	c.telemetry.sendFailures++
+	c.telemetry.lastSendError = err.Error()
+	c.telemetryLock.Unlock()
+}
+
+// queueTelemetry queues the self telemetry events for what was counted since the last ones.
+// There is never more than one of each queued, while one is still queued, e.g. because it failed
+// to send, the counts add up for the next one. So the self telemetry can't flood the queue,
+// and it never triggers a flush on its own.
+func (c *Client) queueTelemetry() {
+	if !c.selfTelemetry {
+		return
+	}
+
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+	c.telemetryLock.Lock()
+	defer c.telemetryLock.Unlock()
+
+	now := c.eventTime()
+	t := &c.telemetry
+	if (t.droppedEvents > 0 || t.droppedIdentifiers > 0) && !c.telemetryQueued(SelfTelemetryDropEvent) {
+		c.eventQueue = append(c.eventQueue, Event{
+			UserID: c.selfTelemetryUserID,
+			Event:  SelfTelemetryDropEvent,
+			Time:   now,
+			Traits: Traits{"events": t.droppedEvents, "identifiers": t.droppedIdentifiers},
+		})
+		t.droppedEvents, t.droppedIdentifiers = 0, 0
+	}
+	if t.sendFailures > 0 && !c.telemetryQueued(SelfTelemetrySendFailureEvent) {
+		c.eventQueue = append(c.eventQueue, Event{
+			UserID: c.selfTelemetryUserID,
+			Event:  SelfTelemetrySendFailureEvent,
+			Time:   now,
+			Traits: Traits{"failures": t.sendFailures, "error": t.lastSendError},
+		})
+		t.sendFailures, t.lastSendError = 0, ""
+	}
+}
+
+// telemetryQueued returns whether the self telemetry event is queued. It must be called with queueLock held.
+func (c *Client) telemetryQueued(name string) bool {
+	for i := range c.eventQueue {
+		if c.eventQueue[i].UserID == c.selfTelemetryUserID && c.eventQueue[i].Event == name {
+			return true
+		}
+	}
+	return false
+}
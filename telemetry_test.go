@@ -0,0 +1,64 @@
+package earnalliance
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfTelemetry(t *testing.T) {
+	transport := &flakyTransport{
+		MemoryTransport: NewMemoryTransport(),
+		fail:            map[int]error{1: errors.New("offline"), 2: errors.New("offline")},
+	}
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithBatchSize(10).
+		WithTransport(transport).
+		WithSelfTelemetry(true).
+		WithSelfTelemetryUserID("sdk").
+		Build()
+	defer client.Close()
+
+	client.Track("asd", "kill", nil, nil)
+	client.Track("asd", "poison", nil, Traits{"callback": func() {}})
+
+	// The batch fails, and the unmarshalable event is dropped
+	require.NotNil(t, client.Flush())
+	require.Len(t, client.eventQueue, 1)
+
+	// The telemetry of the first flush is queued, and fails along with the event
+	require.NotNil(t, client.Flush())
+	require.Len(t, client.eventQueue, 3)
+
+	// The failure of the second flush is counted for the next event, instead of queueing another one
+	require.Nil(t, client.Flush())
+	require.Empty(t, client.eventQueue)
+
+	events := transport.Events()
+	require.Len(t, events, 3)
+	require.Equal(t, "kill", events[0].Event)
+
+	require.Equal(t, "sdk", events[1].UserID)
+	require.Equal(t, SelfTelemetryDropEvent, events[1].Event)
+	require.Equal(t, Traits{"events": float64(1), "identifiers": float64(0)}, events[1].Traits)
+
+	require.Equal(t, "sdk", events[2].UserID)
+	require.Equal(t, SelfTelemetrySendFailureEvent, events[2].Event)
+	require.Equal(t, Traits{"failures": float64(1), "error": "offline"}, events[2].Traits)
+
+	require.Nil(t, client.Flush())
+	events = transport.Events()
+	require.Len(t, events, 4)
+	require.Equal(t, SelfTelemetrySendFailureEvent, events[3].Event)
+	require.Equal(t, Traits{"failures": float64(1), "error": "offline"}, events[3].Traits)
+
+	// Everything was reported, so nothing else is queued
+	require.Nil(t, client.Flush())
+	require.Len(t, transport.Events(), 4)
+}
@@ -0,0 +1,99 @@
+package earnalliance
+
+import "math"
+
+// Trait is a single key and value of Traits, whose value is guaranteed to be serializable.
+// Use TraitString, TraitInt, TraitFloat and TraitBool to create these.
+type Trait struct {
+	key   string
+	value any
+}
+
+// TraitString creates a trait with a string value.
+// It panics if key is empty.
+func TraitString(key string, value string) Trait {
+	return newTrait(key, value)
+}
+
+// TraitInt creates a trait with an integer value.
+// It panics if key is empty.
+func TraitInt(key string, value int) Trait {
+	return newTrait(key, value)
+}
+
+// TraitFloat creates a trait with a floating point value.
+// It panics if key is empty, or if value is NaN or infinite, which JSON can't represent.
+func TraitFloat(key string, value float64) Trait {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		panic("trait value must be a finite number")
+	}
+	return newTrait(key, value)
+}
+
+// TraitBool creates a trait with a boolean value.
+// It panics if key is empty.
+func TraitBool(key string, value bool) Trait {
+	return newTrait(key, value)
+}
+
+func newTrait(key string, value any) Trait {
+	if key == "" {
+		panic("trait key cannot be empty")
+	}
+	return Trait{key: key, value: value}
+}
+
+// TraitsFrom creates Traits from the traits. A later trait overwrites an earlier one with the same key.
+func TraitsFrom(traits ...Trait) Traits {
+	return NewTraits().Add(traits...).Build()
+}
+
+// TraitsBuilder builds Traits fluently out of values that are guaranteed to be serializable,
+// unlike the values of a raw Traits map, which only fail when they are marshalled.
+// It is not concurrency safe. Setting a key again overwrites its value.
+type TraitsBuilder struct {
+	traits Traits
+}
+
+// NewTraits creates a new TraitsBuilder without any traits.
+func NewTraits() *TraitsBuilder {
+	return &TraitsBuilder{traits: Traits{}}
+}
+
+// Add adds the traits.
+func (tb *TraitsBuilder) Add(traits ...Trait) *TraitsBuilder {
+	for _, t := range traits {
+		tb.traits[t.key] = t.value
+	}
+	return tb
+}
+
+// String adds a trait with a string value.
+// It panics if key is empty.
+func (tb *TraitsBuilder) String(key string, value string) *TraitsBuilder {
+	return tb.Add(TraitString(key, value))
+}
+
+// Int adds a trait with an integer value.
+// It panics if key is empty.
+func (tb *TraitsBuilder) Int(key string, value int) *TraitsBuilder {
+	return tb.Add(TraitInt(key, value))
+}
+
+// Float adds a trait with a floating point value.
+// It panics if key is empty, or if value is NaN or infinite.
+func (tb *TraitsBuilder) Float(key string, value float64) *TraitsBuilder {
+	return tb.Add(TraitFloat(key, value))
+}
+
+// Bool adds a trait with a boolean value.
+// It panics if key is empty.
+func (tb *TraitsBuilder) Bool(key string, value bool) *TraitsBuilder {
+	return tb.Add(TraitBool(key, value))
+}
+
+// Build returns the Traits that were built.
+// The builder can keep being used without affecting the returned value.
+func (tb *TraitsBuilder) Build() Traits {
+	return combineTraits(tb.traits)
+}
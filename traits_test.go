@@ -0,0 +1,72 @@
+package earnalliance
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraitsBuilder(t *testing.T) {
+	testCases := []struct {
+		name     string
+		traits   Traits
+		expected Traits
+	}{
+		{
+			name:     "empty",
+			traits:   NewTraits().Build(),
+			expected: Traits{},
+		},
+		{
+			name:   "all types",
+			traits: NewTraits().String("weapon", "sword").Int("kills", 3).Float("accuracy", 0.5).Bool("won", true).Build(),
+			expected: Traits{
+				"weapon":   "sword",
+				"kills":    3,
+				"accuracy": 0.5,
+				"won":      true,
+			},
+		},
+		{
+			name:     "overwrite",
+			traits:   NewTraits().String("weapon", "sword").Add(TraitString("weapon", "bow")).Build(),
+			expected: Traits{"weapon": "bow"},
+		},
+		{
+			name:     "from traits",
+			traits:   TraitsFrom(TraitInt("kills", 3), TraitBool("won", false)),
+			expected: Traits{"kills": 3, "won": false},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.traits)
+
+			_, err := json.Marshal(tc.traits)
+			require.Nil(t, err)
+		})
+	}
+}
+
+func TestTraitsBuilderIsolation(t *testing.T) {
+	tb := NewTraits().String("weapon", "sword")
+	traits := tb.Build()
+	tb.String("weapon", "bow")
+
+	require.Equal(t, Traits{"weapon": "sword"}, traits)
+}
+
+func TestTraitPanics(t *testing.T) {
+	require.PanicsWithValue(t, "trait key cannot be empty", func() {
+		TraitString("", "sword")
+	})
+	require.PanicsWithValue(t, "trait value must be a finite number", func() {
+		TraitFloat("accuracy", math.NaN())
+	})
+	require.PanicsWithValue(t, "trait value must be a finite number", func() {
+		NewTraits().Float("accuracy", math.Inf(1))
+	})
+}
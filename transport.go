@@ -0,0 +1,311 @@
+package earnalliance
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type (
+	// Transport sends the signed payloads of the client to the API.
+	// The headers contain the authentication headers of the payload, and its idempotency key,
+	// which has to be kept when the payload is sent again, so the API can drop duplicates.
+	// The default transport sends the payload over HTTP and retries failed requests,
+	// it can be replaced via WithTransport.
+	Transport interface {
+		Send(ctx context.Context, payload []byte, headers map[string]string) error
+	}
+
+	// ResponseParser decides whether a response of the API is a success, by returning nil,
+	// or an error otherwise. The body is decompressed if the API compressed it.
+	ResponseParser func(status int, body []byte) error
+
+	httpClient interface {
+		Do(req *http.Request) (*http.Response, error)
+	}
+
+	// httpTransport is the default Transport which POSTs the payload to the DSN.
+	httpTransport struct {
+		dsn    string
+		client httpClient
+		// Whether only a 2xx status with a success message is a success
+		strict bool
+		// Replaces the parsing of the response if set
+		parser ResponseParser
+	}
+
+	// APIError is returned by the default transport with strict response parsing
+	// when the API doesn't respond with a 2xx status and a success message.
+	// Without strict response parsing, it is returned when the API rejects the credentials.
+	APIError struct {
+		StatusCode int
+		// The error message of the API, if there is one
+		Message string
+		// The raw response body
+		Body []byte
+	}
+)
+
+func (e *APIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("server returned error: %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("server returned unexpected response: %d: %s", e.StatusCode, e.Body)
+}
+
+// isAuthError returns whether err is an APIError of the API rejecting the credentials.
+func isAuthError(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) &&
+		(apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden)
+}
+
+func (t *httpTransport) Send(ctx context.Context, payload []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", t.dsn, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to do request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if t.parser != nil {
+		return parseResponse(res, t.parser)
+	}
+	if t.strict {
+		return parseStrictResponse(res)
+	}
+
+	if res.StatusCode >= 500 {
+		return fmt.Errorf("server returned server error: %d", res.StatusCode)
+	}
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return parseStrictResponse(res)
+	}
+
+	body, err := responseBody(res)
+	if err != nil {
+		return fmt.Errorf("failed to decode response body: %w", err)
+	}
+
+	var m map[string]any
+	if err := json.NewDecoder(body).Decode(&m); err != nil {
+		return fmt.Errorf("failed to decode response body: %w", err)
+	}
+
+	if b, ok := m["message"]; ok {
+		if s, ok := b.(string); ok {
+			if s == "OK" {
+				return nil
+			}
+		}
+	}
+
+	if b, ok := m["error"]; ok {
+		if s, ok := b.(string); ok {
+			return fmt.Errorf("server returned error: %s", s)
+		}
+	}
+
+	return fmt.Errorf("unexpected response from server: %v", m)
+}
+
+// parseResponse reads the body of res and passes it to parser.
+func parseResponse(res *http.Response, parser ResponseParser) error {
+	body, err := responseBody(res)
+	if err != nil {
+		return fmt.Errorf("failed to decode response body: %w", err)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	return parser(res.StatusCode, b)
+}
+
+// parseStrictResponse returns an APIError unless res has a 2xx status and a success message.
+func parseStrictResponse(res *http.Response) error {
+	body, err := responseBody(res)
+	if err != nil {
+		return fmt.Errorf("failed to decode response body: %w", err)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	var m struct {
+		Message *string `json:"message"`
+		Error   *string `json:"error"`
+	}
+	apiErr := &APIError{StatusCode: res.StatusCode, Body: b}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return apiErr
+	}
+	if m.Error != nil {
+		apiErr.Message = *m.Error
+		return apiErr
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 || m.Message == nil || *m.Message != "OK" {
+		return apiErr
+	}
+	return nil
+}
+
+// responseBody returns the body of res, decompressed if the server compressed it.
+// Accept-Encoding is set explicitly, which stops the HTTP client from decompressing it itself.
+func responseBody(res *http.Response) (io.Reader, error) {
+	if res.Uncompressed || !strings.EqualFold(res.Header.Get("Content-Encoding"), "gzip") {
+		return res.Body, nil
+	}
+	return gzip.NewReader(res.Body)
+}
+
+// MemoryTransport is a Transport that keeps the payloads in memory
+// instead of sending them, and acts as if the API accepted them.
+// It is meant for testing code that uses the client. It is concurrency safe.
+type MemoryTransport struct {
+	lock     sync.Mutex
+	payloads [][]byte
+}
+
+// NewMemoryTransport creates a new MemoryTransport.
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{}
+}
+
+// Send captures a copy of the payload.
+func (m *MemoryTransport) Send(_ context.Context, payload []byte, _ map[string]string) error {
+	m.lock.Lock()
+	m.payloads = append(m.payloads, bytes.Clone(payload))
+	m.lock.Unlock()
+	return nil
+}
+
+// Payloads returns copies of the JSON payloads captured so far, in the order they were sent.
+func (m *MemoryTransport) Payloads() [][]byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	payloads := make([][]byte, 0, len(m.payloads))
+	for _, p := range m.payloads {
+		payloads = append(payloads, bytes.Clone(p))
+	}
+	return payloads
+}
+
+// Events returns the events of all the captured payloads, in the order they were sent.
+// Values that aren't integers, e.g. ones formatted by WithValueFormatter, are left out of the events.
+func (m *MemoryTransport) Events() []Event {
+	var events []Event
+	for _, p := range m.decodePayloads() {
+		events = append(events, p.Events...)
+	}
+	return events
+}
+
+// Identifiers returns the identifier updates of all the captured payloads, in the order they were sent.
+func (m *MemoryTransport) Identifiers() []UserIdentifiers {
+	var identifiers []UserIdentifiers
+	for _, p := range m.decodePayloads() {
+		identifiers = append(identifiers, p.Identifiers...)
+	}
+	return identifiers
+}
+
+// capturedValue is the value of a captured JSON payload, or of a line of a captured NDJSON payload.
+// Identifiers is an array in the former, and a single identifier update in the latter.
+type capturedValue struct {
+	Events      []capturedEvent `json:"events"`
+	Event       *capturedEvent  `json:"event"`
+	Identifiers json.RawMessage `json:"identifiers"`
+}
+
+// capturedEvent is a captured event, whose value may have been formatted by the value formatter.
+type capturedEvent struct {
+	Event
+	Value json.RawMessage `json:"value"`
+}
+
+// event returns the captured event, without its value unless it is an integer.
+func (ce *capturedEvent) event() Event {
+	e := ce.Event
+	var v int
+	if json.Unmarshal(ce.Value, &v) == nil {
+		e.Value = &v
+	}
+	return e
+}
+
+func (m *MemoryTransport) decodePayloads() []payload {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	payloads := make([]payload, 0, len(m.payloads))
+	for _, b := range m.payloads {
+		// A payload can only fail to decode if a custom marshaler encoded it in another format
+		if p, err := decodePayload(b); err == nil {
+			payloads = append(payloads, p)
+		}
+	}
+	return payloads
+}
+
+// decodePayload decodes a payload encoded as JSON, or as NDJSON with one value per line.
+func decodePayload(b []byte) (payload, error) {
+	var p payload
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		var v capturedValue
+		if err := dec.Decode(&v); err != nil {
+			return payload{}, err
+		}
+
+		for i := range v.Events {
+			p.Events = append(p.Events, v.Events[i].event())
+		}
+		if v.Event != nil {
+			p.Events = append(p.Events, v.Event.event())
+		}
+
+		switch {
+		case bytes.HasPrefix(v.Identifiers, []byte("[")):
+			var identifiers []UserIdentifiers
+			if err := json.Unmarshal(v.Identifiers, &identifiers); err != nil {
+				return payload{}, err
+			}
+			p.Identifiers = append(p.Identifiers, identifiers...)
+		case bytes.HasPrefix(v.Identifiers, []byte("{")):
+			var u UserIdentifiers
+			if err := json.Unmarshal(v.Identifiers, &u); err != nil {
+				return payload{}, err
+			}
+			p.Identifiers = append(p.Identifiers, u)
+		}
+	}
+	return p, nil
+}
+
+// Reset removes all the captured payloads.
+func (m *MemoryTransport) Reset() {
+	m.lock.Lock()
+	m.payloads = nil
+	m.lock.Unlock()
+}
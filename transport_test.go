@@ -0,0 +1,109 @@
+package earnalliance_test
+
+import (
+	"strconv"
+	"testing"
+
+	ea "github.com/earn-alliance/earnalliance-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	transport := ea.NewMemoryTransport()
+
+	client := ea.NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithFlushCooldown(0).
+		WithTransport(transport).
+		Build()
+	defer client.Close()
+
+	client.Track("asd", "KILL", ea.PointerFrom(1), nil)
+	client.StartGame("asd")
+
+	err := client.Flush()
+	require.Nil(t, err)
+
+	payloads := transport.Payloads()
+	require.Len(t, payloads, 1)
+	require.Contains(t, string(payloads[0]), `"gameId":"c"`)
+	require.Contains(t, string(payloads[0]), `"event":"KILL"`)
+	require.Contains(t, string(payloads[0]), `"event":"START_GAME"`)
+
+	events := transport.Events()
+	require.Len(t, events, 2)
+	require.Equal(t, "asd", events[0].UserID)
+	require.Equal(t, "KILL", events[0].Event)
+	require.Equal(t, 1, *events[0].Value)
+	require.Equal(t, "START_GAME", events[1].Event)
+
+	client.SetIdentifiers("asd", ea.NewIdentifiers().Discord("d").Remove(ea.SteamID).Build())
+
+	identifiers := transport.Identifiers()
+	require.Len(t, identifiers, 1)
+	require.Equal(t, "asd", identifiers[0].UserID)
+	require.Equal(t, ea.Identifier("d"), *identifiers[0].DiscordID)
+
+	transport.Reset()
+	require.Empty(t, transport.Payloads())
+	require.Empty(t, transport.Events())
+}
+
+func TestMemoryTransportEncodings(t *testing.T) {
+	build := func(transport *ea.MemoryTransport) *ea.ClientBuilder {
+		return ea.NewClientBuilder().
+			WithClientID("a").
+			WithClientSecret("b").
+			WithGameID("c").
+			WithFlushCooldown(0).
+			WithTransport(transport)
+	}
+
+	t.Run("formatted values", func(t *testing.T) {
+		transport := ea.NewMemoryTransport()
+		client := build(transport).
+			WithValueFormatter(func(value *int) any {
+				if value == nil {
+					return nil
+				}
+				return strconv.Itoa(*value)
+			}).
+			Build()
+		defer client.Close()
+
+		client.Track("asd", "KILL", ea.PointerFrom(1), nil)
+		require.Nil(t, client.Flush())
+
+		// The event is decoded, but its value isn't an integer anymore
+		events := transport.Events()
+		require.Len(t, events, 1)
+		require.Equal(t, "KILL", events[0].Event)
+		require.Nil(t, events[0].Value)
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		transport := ea.NewMemoryTransport()
+		client := build(transport).
+			WithPayloadEncoding(ea.PayloadEncodingNDJSON).
+			WithFlushOnIdentifier(false).
+			Build()
+		defer client.Close()
+
+		client.Track("asd", "KILL", ea.PointerFrom(1), nil)
+		client.Track("asd", "DEATH", nil, nil)
+		client.SetIdentifiers("asd", ea.NewIdentifiers().Discord("d").Build())
+		require.Nil(t, client.Flush())
+
+		events := transport.Events()
+		require.Len(t, events, 2)
+		require.Equal(t, "KILL", events[0].Event)
+		require.Equal(t, 1, *events[0].Value)
+		require.Equal(t, "DEATH", events[1].Event)
+
+		identifiers := transport.Identifiers()
+		require.Len(t, identifiers, 1)
+		require.Equal(t, ea.Identifier("d"), *identifiers[0].DiscordID)
+	})
+}
@@ -0,0 +1,90 @@
+package earnalliance
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrTxDone is returned by Tx.Commit and Tx.Rollback, and sent to the error channel by Tx.Track,
+// when the transaction was already committed or rolled back.
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// Tx is a transaction that stages events until it is committed, which queues all of them,
+// or rolled back, which discards them, e.g. to only send the events of a purchase
+// once it went through. It is created by Client.Begin, and it is concurrency safe.
+type Tx struct {
+	c      *Client
+	lock   sync.Mutex
+	events []Event
+	done   bool
+}
+
+// Begin starts a transaction, whose events aren't queued until it is committed.
+func (c *Client) Begin() *Tx {
+	return &Tx{c: c}
+}
+
+// Track stages an event, which is created just like by Client.Track, so the global traits
+// and the time are the ones when it is staged, not when the transaction is committed.
+func (tx *Tx) Track(userID string, eventName string, value *int, traits Traits) {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+
+	if tx.done {
+		tx.c.reportError(ErrTxDone)
+		return
+	}
+
+	tx.events = append(tx.events, Event{
+		Value:  value,
+		UserID: userID,
+		Traits: tx.c.eventTraits(nil, traits),
+		Event:  tx.c.eventName(eventName),
+		Time:   tx.c.eventTime(),
+	})
+}
+
+// Commit adds the staged events to the event queue at once, after applying the event filter.
+// None of them are sent before all of them are queued, unless the queue set via WithQueue
+// is used, which gets them one by one. If the event queue hits the batch size limit,
+// the batch is sent like with Track. It returns ErrClientClosed if the client is closed,
+// in which case nothing is queued, and the transaction can still be rolled back.
+func (tx *Tx) Commit() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+	if tx.c.closed.Load() {
+		return ErrClientClosed
+	}
+	tx.done = true
+
+	events := tx.events[:0]
+	for _, e := range tx.events {
+		tx.c.setDefaults(&e)
+		if tx.c.eventFilter == nil || tx.c.eventFilter(e) {
+			events = append(events, e)
+		}
+	}
+	tx.events = nil
+
+	if len(events) > 0 && tx.c.queueEvents(events) {
+		tx.c.batchFull()
+	}
+	return nil
+}
+
+// Rollback discards the staged events without queueing any of them.
+func (tx *Tx) Rollback() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.events = nil
+	return nil
+}
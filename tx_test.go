@@ -0,0 +1,63 @@
+package earnalliance
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTx(t *testing.T) {
+	errChan := make(chan error, 1)
+
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithTransport(NewMemoryTransport()).
+		WithErrorChannel(errChan).
+		WithEventFilter(func(e Event) bool { return e.Event != "filtered" }).
+		Build()
+	defer client.Close()
+
+	tx := client.Begin()
+	tx.Track("asd", "purchase", PointerFrom(5), nil)
+	tx.Track("asd", "filtered", nil, nil)
+	tx.Track("asd", "gift", nil, nil)
+	require.Empty(t, client.eventQueue)
+
+	require.Nil(t, tx.Commit())
+	require.Len(t, client.eventQueue, 2)
+	require.Equal(t, "purchase", client.eventQueue[0].Event)
+	require.Equal(t, 5, *client.eventQueue[0].Value)
+	require.Equal(t, "gift", client.eventQueue[1].Event)
+
+	// The transaction is done
+	require.Equal(t, ErrTxDone, tx.Commit())
+	require.Equal(t, ErrTxDone, tx.Rollback())
+	tx.Track("asd", "kill", nil, nil)
+	require.Equal(t, ErrTxDone, <-errChan)
+	require.Len(t, client.eventQueue, 2)
+}
+
+func TestTxRollback(t *testing.T) {
+	client := NewClientBuilder().
+		WithClientID("a").
+		WithClientSecret("b").
+		WithGameID("c").
+		WithTransport(NewMemoryTransport()).
+		Build()
+
+	tx := client.Begin()
+	tx.Track("asd", "purchase", nil, nil)
+	require.Nil(t, tx.Rollback())
+	require.Equal(t, ErrTxDone, tx.Commit())
+	require.Empty(t, client.eventQueue)
+
+	// A transaction that couldn't be committed can be rolled back
+	tx = client.Begin()
+	tx.Track("asd", "purchase", nil, nil)
+	client.Close()
+	require.Equal(t, ErrClientClosed, tx.Commit())
+	require.Nil(t, tx.Rollback())
+	require.Empty(t, client.eventQueue)
+}
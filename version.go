@@ -0,0 +1,10 @@
+package earnalliance
+
+// sdkVersion is the version of this library. It must be updated with every release.
+const sdkVersion = "1.0.0"
+
+// Version returns the version of this library. It is sent to the API
+// in the x-sdk-version header of every request.
+func Version() string {
+	return sdkVersion
+}
@@ -0,0 +1,84 @@
+package earnalliance
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultWebhookTolerance is the maximum difference between the x-timestamp header
+// of a webhook and the current time that VerifyWebhook accepts.
+const DefaultWebhookTolerance = 5 * time.Minute
+
+var (
+	// ErrMissingWebhookHeader is returned by VerifyWebhook when one of the
+	// x-client-id, x-timestamp or x-signature headers is missing.
+	ErrMissingWebhookHeader = errors.New("missing webhook header")
+	// ErrInvalidWebhookSignature is returned by VerifyWebhook when the
+	// signature doesn't match the body.
+	ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+	// ErrInvalidWebhookTimestamp is returned by VerifyWebhook when the
+	// x-timestamp header isn't a Unix time in milliseconds, or when it is
+	// outside of the accepted tolerance, e.g. because the webhook is replayed.
+	ErrInvalidWebhookTimestamp = errors.New("invalid webhook timestamp")
+)
+
+// VerifyWebhook verifies that a webhook sent by Earn Alliance was signed with secret.
+// The signature is checked with the same scheme the client uses to sign its requests,
+// and it is compared in constant time.
+// The timestamp must be within DefaultWebhookTolerance of the current time.
+// The returned error wraps ErrMissingWebhookHeader, ErrInvalidWebhookTimestamp
+// or ErrInvalidWebhookSignature.
+func VerifyWebhook(secret string, headers http.Header, body []byte) error {
+	return VerifyWebhookWithTolerance(secret, headers, body, DefaultWebhookTolerance)
+}
+
+// VerifyWebhookWithTolerance is like VerifyWebhook, but the timestamp must be
+// within tolerance of the current time instead. A tolerance of 0 disables the
+// timestamp check, which leaves the webhook open to replays.
+func VerifyWebhookWithTolerance(secret string, headers http.Header, body []byte, tolerance time.Duration) error {
+	if tolerance < 0 {
+		panic("webhook tolerance cannot be negative")
+	}
+
+	for _, name := range []string{"x-client-id", "x-timestamp", "x-signature"} {
+		if headers.Get(name) == "" {
+			return fmt.Errorf("%w: %s", ErrMissingWebhookHeader, name)
+		}
+	}
+
+	clientID := headers.Get("x-client-id")
+	timestamp := headers.Get("x-timestamp")
+	signature := headers.Get("x-signature")
+
+	if tolerance > 0 {
+		ms, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidWebhookTimestamp, timestamp)
+		}
+		skew := time.Since(time.UnixMilli(ms))
+		if skew > tolerance || skew < -tolerance {
+			return fmt.Errorf("%w: %s is %s off", ErrInvalidWebhookTimestamp, timestamp, skew.Round(time.Second))
+		}
+	}
+
+	received, err := hex.DecodeString(signature)
+	if err != nil {
+		return ErrInvalidWebhookSignature
+	}
+
+	expected, err := hmacSum(clientID, secret, timestamp, body)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(expected, received) {
+		return ErrInvalidWebhookSignature
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package earnalliance_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	ea "github.com/earn-alliance/earnalliance-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyWebhook(t *testing.T) {
+	// a123hello signed with "b"
+	validSignature := "8713437da9757423053fb5beb3e58794321ac22055d5c8fbf0cd0c6b9f5675e5"
+
+	testCases := []struct {
+		name        string
+		headers     map[string]string
+		body        string
+		expectedErr error
+	}{
+		{
+			name: "valid",
+			headers: map[string]string{
+				"X-Client-Id": "a",
+				"X-Timestamp": "123",
+				"X-Signature": validSignature,
+			},
+			body: "hello",
+		},
+		{
+			name: "missing client id",
+			headers: map[string]string{
+				"X-Timestamp": "123",
+				"X-Signature": validSignature,
+			},
+			body:        "hello",
+			expectedErr: ea.ErrMissingWebhookHeader,
+		},
+		{
+			name: "missing signature",
+			headers: map[string]string{
+				"X-Client-Id": "a",
+				"X-Timestamp": "123",
+			},
+			body:        "hello",
+			expectedErr: ea.ErrMissingWebhookHeader,
+		},
+		{
+			name: "different body",
+			headers: map[string]string{
+				"X-Client-Id": "a",
+				"X-Timestamp": "123",
+				"X-Signature": validSignature,
+			},
+			body:        "hello!",
+			expectedErr: ea.ErrInvalidWebhookSignature,
+		},
+		{
+			name: "different timestamp",
+			headers: map[string]string{
+				"X-Client-Id": "a",
+				"X-Timestamp": "124",
+				"X-Signature": validSignature,
+			},
+			body:        "hello",
+			expectedErr: ea.ErrInvalidWebhookSignature,
+		},
+		{
+			name: "signature isn't hex",
+			headers: map[string]string{
+				"X-Client-Id": "a",
+				"X-Timestamp": "123",
+				"X-Signature": "not hex",
+			},
+			body:        "hello",
+			expectedErr: ea.ErrInvalidWebhookSignature,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := http.Header{}
+			for k, v := range tc.headers {
+				headers.Set(k, v)
+			}
+
+			// The fixed timestamp is only valid without the tolerance
+			err := ea.VerifyWebhookWithTolerance("b", headers, []byte(tc.body), 0)
+			if tc.expectedErr == nil {
+				require.Nil(t, err)
+			} else {
+				require.True(t, errors.Is(err, tc.expectedErr), err)
+			}
+		})
+	}
+}
+
+func TestVerifyWebhookTimestamp(t *testing.T) {
+	testCases := []struct {
+		name        string
+		timestamp   string
+		expectedErr error
+	}{
+		{
+			name:      "now",
+			timestamp: webhookTimestamp(time.Now()),
+		},
+		{
+			name:      "within tolerance",
+			timestamp: webhookTimestamp(time.Now().Add(-4 * time.Minute)),
+		},
+		{
+			name:        "too old",
+			timestamp:   webhookTimestamp(time.Now().Add(-6 * time.Minute)),
+			expectedErr: ea.ErrInvalidWebhookTimestamp,
+		},
+		{
+			name:        "in the future",
+			timestamp:   webhookTimestamp(time.Now().Add(6 * time.Minute)),
+			expectedErr: ea.ErrInvalidWebhookTimestamp,
+		},
+		{
+			name:        "not a number",
+			timestamp:   "yesterday",
+			expectedErr: ea.ErrInvalidWebhookTimestamp,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := http.Header{}
+			headers.Set("X-Client-Id", "a")
+			headers.Set("X-Timestamp", tc.timestamp)
+			headers.Set("X-Signature", webhookSignature("b", "a", tc.timestamp, "hello"))
+
+			err := ea.VerifyWebhook("b", headers, []byte("hello"))
+			if tc.expectedErr == nil {
+				require.Nil(t, err)
+			} else {
+				require.True(t, errors.Is(err, tc.expectedErr), err)
+			}
+		})
+	}
+}
+
+func webhookTimestamp(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+func webhookSignature(secret, clientID, timestamp, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(clientID + timestamp + body))
+	return hex.EncodeToString(mac.Sum(nil))
+}